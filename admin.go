@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Path under which the cache administration endpoints are served.
+const adminPathPrefix = "/admin/"
+
+// adminCacheStats is the response of the cache stats endpoint.
+type adminCacheStats struct {
+	cacheStats
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// adminCacheEntry describes one cache entry in responses of the source endpoint.
+type adminCacheEntry struct {
+	Key     string     `json:"key"`
+	Size    int64      `json:"bytes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// adminSource is the response of the source lookup endpoint.
+type adminSource struct {
+	URL     string            `json:"url"`
+	Info    *sourceInfo       `json:"info"`
+	Entries []adminCacheEntry `json:"entries"`
+	Size    int64             `json:"bytes"`
+}
+
+// adminPurge is the response of the purge endpoints.
+type adminPurge struct {
+	Sources int `json:"sources"`
+	Entries int `json:"entries"`
+}
+
+// checkAdminToken checks the bearer token of an admin request.
+func checkAdminToken(r *http.Request) error {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(conf.AdminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+		return invalidAdminTokenErr
+	}
+	return nil
+}
+
+// lookupCachedSource returns what's cached for the source at url.
+func lookupCachedSource(url string) (adminSource, error) {
+	source := adminSource{URL: url, Entries: []adminCacheEntry{}}
+	if info, ok := readSourceInfo(url); ok {
+		source.Info = &info
+	}
+
+	keys, err := farsparkCache.Keys(getSourceKeyPrefix(url))
+	if err != nil {
+		return source, err
+	}
+	for _, key := range keys {
+		info, err := farsparkCache.Stat(key)
+		if err != nil {
+			continue
+		}
+
+		entry := adminCacheEntry{Key: key, Size: info.Size, Created: info.Created}
+		if !info.Expires.IsZero() {
+			entry.Expires = &info.Expires
+		}
+		source.Entries = append(source.Entries, entry)
+		source.Size += info.Size
+	}
+	return source, nil
+}
+
+// purgeCachedSource deletes the source at url from the cache, along with everything derived from
+// it, and returns how many entries were deleted.
+func purgeCachedSource(url string) (int, error) {
+	keys, err := farsparkCache.Keys(getSourceKeyPrefix(url))
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := farsparkCache.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// cachedSourceURL returns the URL recorded in the source info or URL entry at key.
+func cachedSourceURL(key string) (string, bool) {
+	if !isSourceInfoCacheKey(key) && !isSourceURLCacheKey(key) {
+		return "", false
+	}
+
+	data, err := farsparkCache.Get(key)
+	if err != nil {
+		return "", false
+	}
+	if isSourceURLCacheKey(key) {
+		return string(data), true
+	}
+
+	var info sourceInfo
+	if json.Unmarshal(data, &info) != nil {
+		return "", false
+	}
+	return info.URL, true
+}
+
+// purgeCachedSources purges every source whose URL starts with prefix. Sources are found by
+// their info, or the URL recorded with raw responses, so those whose entries outlived both are
+// missed.
+func purgeCachedSources(prefix string) (adminPurge, error) {
+	var purge adminPurge
+
+	keys, err := farsparkCache.Keys("")
+	if err != nil {
+		return purge, err
+	}
+	for _, key := range keys {
+		// Sources with both were already purged along with the first one found
+		url, ok := cachedSourceURL(key)
+		if !ok || !strings.HasPrefix(url, prefix) {
+			continue
+		}
+
+		entries, err := purgeCachedSource(url)
+		purge.Entries += entries
+		if err != nil {
+			return purge, err
+		}
+		purge.Sources++
+	}
+	return purge, nil
+}
+
+// serveAdmin serves the cache administration endpoints:
+//
+//	GET /admin/cache/stats - numbers of entries, bytes, hits and misses
+//	GET /admin/cache/source?url=<url> - what's cached for a source
+//	DELETE /admin/cache/source?url=<url> - purges a source and everything derived from it
+//	DELETE /admin/cache/source?prefix=<prefix> - purges every source whose URL starts with prefix
+func serveAdmin(reqID string, rw http.ResponseWriter, r *http.Request) {
+	if len(conf.AdminToken) == 0 {
+		panic(newError(404, "Admin endpoints are disabled", "Invalid endpoint specified"))
+	}
+	if err := checkAdminToken(r); err != nil {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		panic(err)
+	}
+	if farsparkCache == nil {
+		panic(newError(404, "Cache is disabled", "Cache is disabled"))
+	}
+
+	t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
+	query := r.URL.Query()
+
+	var response interface{}
+	switch path := strings.TrimPrefix(r.URL.Path, adminPathPrefix); {
+	case path == "cache/stats" && r.Method == http.MethodGet:
+		stats, err := farsparkCache.Stats()
+		if err != nil {
+			panic(newError(500, err.Error(), "Error reading cache stats"))
+		}
+		response = adminCacheStats{stats, stats.HitRatio()}
+
+	case path == "cache/source" && r.Method == http.MethodGet:
+		if len(query.Get("url")) == 0 {
+			panic(newError(400, "Missing url", "Missing url"))
+		}
+		source, err := lookupCachedSource(query.Get("url"))
+		if err != nil {
+			panic(newError(500, err.Error(), "Error reading cache"))
+		}
+		response = source
+
+	case path == "cache/source" && r.Method == http.MethodDelete:
+		var purge adminPurge
+		var err error
+		if url := query.Get("url"); len(url) > 0 {
+			if purge.Entries, err = purgeCachedSource(url); purge.Entries > 0 {
+				purge.Sources = 1
+			}
+		} else if prefix := query.Get("prefix"); len(prefix) > 0 {
+			purge, err = purgeCachedSources(prefix)
+		} else {
+			panic(newError(400, "Missing url or prefix", "Missing url or prefix"))
+		}
+		if err != nil {
+			panic(newError(500, err.Error(), "Error purging cache"))
+		}
+		response = purge
+
+	case path == "cache/stats" || path == "cache/source":
+		panic(invalidMethodErr)
+
+	default:
+		panic(newError(404, fmt.Sprintf("Invalid admin endpoint: %s", path), "Invalid endpoint specified"))
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		panic(newUnexpectedError(err, 1))
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	respondWithMedia(reqID, r, rw, data, r.URL.Path, "application/json", t.Since())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method string, path string, token string, response interface{}) int {
+	r := httptest.NewRequest(method, path, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	newHTTPHandler().ServeHTTP(rw, r)
+
+	if rw.Code == 200 && response != nil {
+		if err := json.Unmarshal(rw.Body.Bytes(), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rw.Code
+}
+
+func Test_admin_authentication(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.AdminToken = ""
+	if code := adminRequest(t, http.MethodGet, "/admin/cache/stats", "", nil); code != 404 {
+		t.Fatalf("Expected admin endpoints to be disabled without a token, got %d", code)
+	}
+
+	conf.AdminToken = "secret"
+	if code := adminRequest(t, http.MethodGet, "/admin/cache/stats", "wrong", nil); code != 401 {
+		t.Fatalf("Expected a wrong token to be rejected, got %d", code)
+	}
+}
+
+func Test_admin_cache(t *testing.T) {
+	oldConf, oldCache := conf, farsparkCache
+	defer func() { conf, farsparkCache = oldConf, oldCache }()
+	conf.AdminToken = "secret"
+	memory := newMemoryCache(1 << 20)
+	farsparkCache = memory
+
+	sources := []string{"https://example.com/a.pdf", "https://example.com/b.pdf", "https://other.example.com/a.pdf"}
+	for _, source := range sources {
+		writeSourceInfo(source, sourceInfo{URL: source, Version: "1", FreshUntil: time.Now().Add(time.Hour)})
+		farsparkCache.Put(getSourceCacheKey(source), []byte("%PDF-1.4"), 0)
+		farsparkCache.Put(getIndexContentsCacheKey(source, "1", 0, ""), []byte("page"), 0)
+	}
+	// Raw responses are cached without any info about their source
+	rawSource := "https://example.com/c.png"
+	writeCachedResponse(getRawCacheKey(rawSource, "", rewriteOptions{}), cachedResponse{http.Header{}, []byte("png")}, time.Hour)
+	writeSourceURL(rawSource, time.Hour)
+
+	farsparkCache = &countingCache{Cache: memory}
+	farsparkCache.Get(getSourceCacheKey(sources[0]))
+	farsparkCache.Get("missing")
+	readSourceInfo(sources[0])
+	readSourceInfo("https://example.com/missing.pdf")
+
+	var stats adminCacheStats
+	if code := adminRequest(t, http.MethodGet, "/admin/cache/stats", "secret", &stats); code != 200 {
+		t.Fatalf("Expected stats, got %d", code)
+	}
+	if stats.Entries != 11 || stats.Hits != 1 || stats.Misses != 1 || stats.HitRatio != 0.5 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	var source adminSource
+	path := "/admin/cache/source?url=" + url.QueryEscape(sources[0])
+	if code := adminRequest(t, http.MethodGet, path, "secret", &source); code != 200 {
+		t.Fatalf("Expected the source, got %d", code)
+	}
+	if source.Info == nil || source.Info.Version != "1" || len(source.Entries) != 3 || source.Size == 0 {
+		t.Fatalf("Unexpected source %+v", source)
+	}
+
+	var purge adminPurge
+	if code := adminRequest(t, http.MethodDelete, path, "secret", &purge); code != 200 || purge.Sources != 1 || purge.Entries != 3 {
+		t.Fatalf("Expected the source to be purged, got %d %+v", code, purge)
+	}
+	if farsparkCache.Has(getSourceCacheKey(sources[0])) {
+		t.Fatal("Expected the purged source to be gone")
+	}
+
+	path = "/admin/cache/source?prefix=" + url.QueryEscape("https://example.com/")
+	if code := adminRequest(t, http.MethodDelete, path, "secret", &purge); code != 200 || purge.Sources != 2 || purge.Entries != 5 {
+		t.Fatalf("Expected the sources with the prefix to be purged, got %d %+v", code, purge)
+	}
+	if farsparkCache.Has(getIndexContentsCacheKey(sources[1], "1", 0, "")) || farsparkCache.Has(getRawCacheKey(rawSource, "", rewriteOptions{})) || !farsparkCache.Has(getIndexContentsCacheKey(sources[2], "1", 0, "")) {
+		t.Fatal("Expected only the sources with the prefix to be purged")
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"strconv"
+
+	"golang.org/x/image/webp"
+)
+
+var animatedMimeTypes = map[mimeType]bool{
+	"image/gif":  true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+var (
+	errInvalidAnimation = errors.New("Invalid animation")
+	errAnimationTooBig  = errors.New("Source image is too big")
+	errTooManyFrames    = errors.New("Animation has too many frames")
+)
+
+// maxAnimationBytes returns the most memory the frames of an animation may take, so that small
+// files with a huge canvas or number of frames can't exhaust memory or time: as much as a source
+// image at the maximum resolution takes decoded, at 4 bytes per pixel. GIF frames are all decoded
+// at once, at a byte per pixel, while the source is held too; APNG and WebP frames are decoded one
+// at a time up to the requested one, but are held to the same number of pixels.
+func maxAnimationBytes() int64 {
+	return 4 * int64(conf.MaxResolution)
+}
+
+// checkAnimationSize rejects animations whose canvas is bigger than the maximum dimension, or
+// whose frames together, at a byte per pixel of the canvas, and heldBytes of source data take more
+// than maxAnimationBytes.
+func checkAnimationSize(width int, height int, frameCount int, heldBytes int) error {
+	if width > conf.MaxDimension || height > conf.MaxDimension {
+		return errAnimationTooBig
+	}
+	if int64(width)*int64(height)*int64(frameCount)+int64(heldBytes) > maxAnimationBytes() {
+		return errTooManyFrames
+	}
+	return nil
+}
+
+// animationFrame is a single frame of an animation, positioned on the animation's canvas.
+type animationFrame struct {
+	Image           image.Image
+	Bounds          image.Rectangle
+	DisposeToBG     bool
+	DisposeToPrev   bool
+	BlendOverCanvas bool
+}
+
+// animation is a lazily decoded animation: frames are only decoded up to the requested one.
+type animation struct {
+	Width      int
+	Height     int
+	FrameCount int
+	Frame      func(i int) (animationFrame, error)
+}
+
+// extractAnimationFrame renders frame index of an animated GIF, APNG or WebP. Static images are
+// treated as animations with a single frame.
+func extractAnimationFrame(data []byte, sourceType mimeType, url string, index int, opts extractOptions) ([]byte, int, error) {
+	var anim *animation
+	var err error
+
+	switch sourceType {
+	case "image/gif":
+		anim, err = decodeGIFAnimation(data)
+	case "image/png":
+		anim, err = decodePNGAnimation(data)
+	case "image/webp":
+		anim, err = decodeWebPAnimation(data)
+	default:
+		return nil, 0, fmt.Errorf("Unsupported animation type: %s", sourceType)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if index < 0 || index >= anim.FrameCount {
+		return nil, 0, errIndexOutOfRange
+	}
+
+	frame, err := renderAnimationFrame(anim, index)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, frame); err != nil {
+		return nil, 0, err
+	}
+
+	outBytes := out.Bytes()
+	if opts.Format != "image/png" {
+		if outBytes, err = transcodeImage(outBytes, opts.Format, opts.quality()); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	maxIndex := anim.FrameCount - 1
+
+	if farsparkCache != nil {
+		version := sourceVersion(url)
+		farsparkCache.Put(getIndexContentsCacheKey(url, version, index, opts.cacheVariant()), outBytes, 0)
+		farsparkCache.Put(getMaxIndexCacheKey(url, version), []byte(strconv.Itoa(maxIndex)), 0)
+	}
+
+	return outBytes, maxIndex, nil
+}
+
+// renderAnimationFrame composites frames 0 through index onto a canvas, honoring each frame's
+// blending and disposal, and returns the canvas as it looks while frame index is shown.
+func renderAnimationFrame(anim *animation, index int) (image.Image, error) {
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.Width, anim.Height))
+
+	for i := 0; i <= index; i++ {
+		frame, err := anim.Frame(i)
+		if err != nil {
+			return nil, err
+		}
+
+		var previous *image.RGBA
+		if frame.DisposeToPrev && i < index {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		op := draw.Src
+		if frame.BlendOverCanvas {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frame.Bounds, frame.Image, frame.Image.Bounds().Min, op)
+
+		if i == index {
+			break
+		}
+
+		if frame.DisposeToBG {
+			draw.Draw(canvas, frame.Bounds, image.Transparent, image.Point{}, draw.Src)
+		} else if previous != nil {
+			canvas = previous
+		}
+	}
+
+	return canvas, nil
+}
+
+// countGIFFrames counts the image descriptors in a GIF by skipping over its blocks, without
+// decompressing any of them. Counting stops early at anything malformed, which decoding rejects.
+func countGIFFrames(data []byte) int {
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (uint(data[10]&0x07) + 1) // global color table
+	}
+
+	// skipSubBlocks returns the position after the sub-blocks starting at pos
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos = skipSubBlocks(pos + 2)
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return frames
+			}
+			frames++
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&0x07) + 1) // local color table
+			}
+			pos = skipSubBlocks(pos + 1) // after the LZW minimum code size
+		default: // trailer, or anything unexpected
+			return frames
+		}
+	}
+	return frames
+}
+
+// decodeGIFAnimation decodes every frame of a GIF, after checking its size and number of frames
+// so it won't decode into too much memory.
+func decodeGIFAnimation(data []byte) (*animation, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAnimationSize(config.Width, config.Height, countGIFFrames(data), len(data)); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return &animation{
+		Width:      g.Config.Width,
+		Height:     g.Config.Height,
+		FrameCount: len(g.Image),
+		Frame: func(i int) (animationFrame, error) {
+			var disposal byte
+			if i < len(g.Disposal) {
+				disposal = g.Disposal[i]
+			}
+			return animationFrame{
+				Image:           g.Image[i],
+				Bounds:          g.Image[i].Bounds(),
+				DisposeToBG:     disposal == gif.DisposalBackground,
+				DisposeToPrev:   disposal == gif.DisposalPrevious,
+				BlendOverCanvas: true,
+			}, nil
+		},
+	}, nil
+}
+
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errInvalidAnimation
+	}
+
+	chunks := make([]pngChunk, 0)
+	for pos := len(pngSignature); pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errInvalidAnimation
+		}
+		chunks = append(chunks, pngChunk{string(data[pos+4 : pos+8]), data[pos+8 : pos+8+length]})
+		pos = end
+	}
+
+	return chunks, nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	buf.WriteString(chunkType)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// decodePNGAnimation decodes APNGs by reassembling each frame into a standalone PNG; PNGs
+// without an acTL chunk are a single frame.
+func decodePNGAnimation(data []byte) (*animation, error) {
+	chunks, err := readPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 || chunks[0].Type != "IHDR" || len(chunks[0].Data) != 13 {
+		return nil, errInvalidAnimation
+	}
+	ihdr := chunks[0].Data
+	width := int(binary.BigEndian.Uint32(ihdr[0:]))
+	height := int(binary.BigEndian.Uint32(ihdr[4:]))
+	if width <= 0 || height <= 0 {
+		return nil, errInvalidAnimation
+	}
+
+	type apngFrame struct {
+		fctl []byte
+		data [][]byte
+	}
+
+	var isAnimated bool
+	var frames []*apngFrame
+	var current *apngFrame
+	var shared []pngChunk // ancillary chunks every frame needs, e.g. PLTE and tRNS
+
+	for _, chunk := range chunks[1:] {
+		switch chunk.Type {
+		case "acTL":
+			isAnimated = true
+		case "fcTL":
+			if len(chunk.Data) != 26 {
+				return nil, errInvalidAnimation
+			}
+			// Frames must be non-empty and lie within the canvas
+			frameWidth := uint64(binary.BigEndian.Uint32(chunk.Data[4:]))
+			frameHeight := uint64(binary.BigEndian.Uint32(chunk.Data[8:]))
+			x := uint64(binary.BigEndian.Uint32(chunk.Data[12:]))
+			y := uint64(binary.BigEndian.Uint32(chunk.Data[16:]))
+			if frameWidth == 0 || frameHeight == 0 || x+frameWidth > uint64(width) || y+frameHeight > uint64(height) {
+				return nil, errInvalidAnimation
+			}
+			current = &apngFrame{fctl: chunk.Data}
+			frames = append(frames, current)
+		case "IDAT":
+			// The default image is only part of the animation if an fcTL precedes it
+			if current != nil {
+				current.data = append(current.data, chunk.Data)
+			}
+		case "fdAT":
+			if current == nil || len(chunk.Data) < 4 {
+				return nil, errInvalidAnimation
+			}
+			current.data = append(current.data, chunk.Data[4:])
+		case "IEND":
+		default:
+			if len(frames) == 0 {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+
+	if !isAnimated || len(frames) == 0 {
+		if err := checkAnimationSize(width, height, 1, 0); err != nil {
+			return nil, err
+		}
+		return &animation{
+			Width:      width,
+			Height:     height,
+			FrameCount: 1,
+			Frame: func(i int) (animationFrame, error) {
+				img, err := png.Decode(bytes.NewReader(data))
+				if err != nil {
+					return animationFrame{}, err
+				}
+				return animationFrame{Image: img, Bounds: img.Bounds()}, nil
+			},
+		}, nil
+	}
+
+	if err := checkAnimationSize(width, height, len(frames), 0); err != nil {
+		return nil, err
+	}
+
+	return &animation{
+		Width:      width,
+		Height:     height,
+		FrameCount: len(frames),
+		Frame: func(i int) (animationFrame, error) {
+			fctl := frames[i].fctl
+			frameWidth := binary.BigEndian.Uint32(fctl[4:])
+			frameHeight := binary.BigEndian.Uint32(fctl[8:])
+			x := int(binary.BigEndian.Uint32(fctl[12:]))
+			y := int(binary.BigEndian.Uint32(fctl[16:]))
+			disposeOp := fctl[24]
+			blendOp := fctl[25]
+
+			frameIHDR := make([]byte, len(ihdr))
+			copy(frameIHDR, ihdr)
+			binary.BigEndian.PutUint32(frameIHDR[0:], frameWidth)
+			binary.BigEndian.PutUint32(frameIHDR[4:], frameHeight)
+
+			var buf bytes.Buffer
+			buf.Write(pngSignature)
+			writePNGChunk(&buf, "IHDR", frameIHDR)
+			for _, chunk := range shared {
+				writePNGChunk(&buf, chunk.Type, chunk.Data)
+			}
+			for _, d := range frames[i].data {
+				writePNGChunk(&buf, "IDAT", d)
+			}
+			writePNGChunk(&buf, "IEND", nil)
+
+			img, err := png.Decode(&buf)
+			if err != nil {
+				return animationFrame{}, err
+			}
+
+			return animationFrame{
+				Image:           img,
+				Bounds:          image.Rect(x, y, x+int(frameWidth), y+int(frameHeight)),
+				DisposeToBG:     disposeOp == 1,
+				DisposeToPrev:   disposeOp == 2,
+				BlendOverCanvas: blendOp == 1,
+			}, nil
+		},
+	}, nil
+}
+
+type webpChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	chunks := make([]webpChunk, 0)
+	for pos := 0; pos+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length
+		if length < 0 || end > len(data) {
+			return nil, errInvalidAnimation
+		}
+		chunks = append(chunks, webpChunk{string(data[pos : pos+4]), data[pos+8 : end]})
+		pos = end + length%2
+	}
+	return chunks, nil
+}
+
+func writeWebPChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func readUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// decodeWebPAnimation decodes animated WebPs by reassembling each ANMF frame into a standalone
+// WebP; WebPs without ANMF chunks are a single frame. ANMF frames must follow the VP8X chunk
+// which sizes their canvas, and lie within it.
+func decodeWebPAnimation(data []byte) (*animation, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errInvalidAnimation
+	}
+
+	chunks, err := readWebPChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	var width, height int
+	var frames []webpChunk
+	for _, chunk := range chunks {
+		switch chunk.FourCC {
+		case "VP8X":
+			if len(chunk.Data) != 10 {
+				return nil, errInvalidAnimation
+			}
+			width = readUint24(chunk.Data[4:]) + 1
+			height = readUint24(chunk.Data[7:]) + 1
+		case "ANMF":
+			if width == 0 || len(chunk.Data) < 16 {
+				return nil, errInvalidAnimation
+			}
+			x := readUint24(chunk.Data[0:]) * 2
+			y := readUint24(chunk.Data[3:]) * 2
+			if x+readUint24(chunk.Data[6:])+1 > width || y+readUint24(chunk.Data[9:])+1 > height {
+				return nil, errInvalidAnimation
+			}
+			frames = append(frames, chunk)
+		}
+	}
+
+	if len(frames) == 0 {
+		config, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkAnimationSize(config.Width, config.Height, 1, 0); err != nil {
+			return nil, err
+		}
+		return &animation{
+			Width:      config.Width,
+			Height:     config.Height,
+			FrameCount: 1,
+			Frame: func(i int) (animationFrame, error) {
+				img, err := webp.Decode(bytes.NewReader(data))
+				if err != nil {
+					return animationFrame{}, err
+				}
+				return animationFrame{Image: img, Bounds: img.Bounds()}, nil
+			},
+		}, nil
+	}
+
+	if err := checkAnimationSize(width, height, len(frames), 0); err != nil {
+		return nil, err
+	}
+
+	return &animation{
+		Width:      width,
+		Height:     height,
+		FrameCount: len(frames),
+		Frame: func(i int) (animationFrame, error) {
+			header := frames[i].Data
+			x := readUint24(header[0:]) * 2
+			y := readUint24(header[3:]) * 2
+			frameWidth := readUint24(header[6:]) + 1
+			frameHeight := readUint24(header[9:]) + 1
+			flags := header[15]
+
+			frameChunks, err := readWebPChunks(header[16:])
+			if err != nil {
+				return animationFrame{}, err
+			}
+
+			var body bytes.Buffer
+			for _, chunk := range frameChunks {
+				if chunk.FourCC == "ALPH" {
+					vp8x := make([]byte, 10)
+					vp8x[0] = 1 << 4 // alpha
+					putUint24(vp8x[4:], frameWidth-1)
+					putUint24(vp8x[7:], frameHeight-1)
+					writeWebPChunk(&body, "VP8X", vp8x)
+					break
+				}
+			}
+			for _, chunk := range frameChunks {
+				if chunk.FourCC == "ALPH" || chunk.FourCC == "VP8 " || chunk.FourCC == "VP8L" {
+					writeWebPChunk(&body, chunk.FourCC, chunk.Data)
+				}
+			}
+
+			var buf bytes.Buffer
+			buf.WriteString("RIFF")
+			binary.Write(&buf, binary.LittleEndian, uint32(4+body.Len()))
+			buf.WriteString("WEBP")
+			buf.Write(body.Bytes())
+
+			img, err := webp.Decode(&buf)
+			if err != nil {
+				return animationFrame{}, err
+			}
+
+			return animationFrame{
+				Image:           img,
+				Bounds:          image.Rect(x, y, x+frameWidth, y+frameHeight),
+				DisposeToBG:     flags&0x01 != 0,
+				BlendOverCanvas: flags&0x02 == 0,
+			}, nil
+		},
+	}, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var testFrameColors = []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+
+func solidImage(c color.RGBA, w int, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func decodeExtractedFrame(t *testing.T, data []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func assertColor(t *testing.T, img image.Image, x int, y int, expected color.RGBA) {
+	r, g, b, a := img.At(x, y).RGBA()
+	actual := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	if actual != expected {
+		t.Fatalf("Expected %v at (%d, %d), got %v", expected, x, y, actual)
+	}
+}
+
+func Test_GIF_frames(t *testing.T) {
+	palette := color.Palette{color.Transparent, testFrameColors[0], testFrameColors[1], testFrameColors[2]}
+	anim := &gif.GIF{Config: image.Config{Width: 4, Height: 4, ColorModel: palette}}
+
+	for i := range testFrameColors {
+		// Each frame only covers the top-left quadrant after the first
+		bounds := image.Rect(0, 0, 4, 4)
+		if i > 0 {
+			bounds = image.Rect(0, 0, 2, 2)
+		}
+		frame := image.NewPaletted(bounds, palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i + 1)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	result, maxIndex, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxIndex != 2 {
+		t.Fatalf("Expected max index 2, got %d", maxIndex)
+	}
+
+	img := decodeExtractedFrame(t, result)
+	assertColor(t, img, 0, 0, testFrameColors[2])
+	assertColor(t, img, 3, 3, testFrameColors[0])
+
+	if _, _, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", 3, opts); err != errIndexOutOfRange {
+		t.Fatalf("Expected out of range error, got %v", err)
+	}
+	if _, _, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", -1, opts); err != errIndexOutOfRange {
+		t.Fatalf("Expected out of range error for a negative index, got %v", err)
+	}
+	if frames := countGIFFrames(buf.Bytes()); frames != 3 {
+		t.Fatalf("Expected 3 frames to be counted, got %d", frames)
+	}
+}
+
+func Test_GIF_too_many_frames(t *testing.T) {
+	// Tiny frames on a big canvas, which would each be decoded at the size of the canvas
+	palette := color.Palette{color.Transparent, testFrameColors[0]}
+	anim := &gif.GIF{Config: image.Config{Width: 2048, Height: 2048, ColorModel: palette}}
+	for i := 0; i < 65; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	if _, _, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", 0, opts); err != errTooManyFrames {
+		t.Fatalf("Expected the GIF to be rejected, got %v", err)
+	}
+}
+
+func Test_GIF_source_counts_towards_limit(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	palette := color.Palette{color.Transparent, testFrameColors[0]}
+	anim := &gif.GIF{Config: image.Config{Width: 10, Height: 10, ColorModel: palette}}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	// The frames alone fit, but not along with the source
+	conf.MaxResolution = (300 + buf.Len() - 1) / 4
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	if _, _, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", 0, opts); err != errTooManyFrames {
+		t.Fatalf("Expected the GIF to be rejected, got %v", err)
+	}
+
+	conf.MaxResolution = (300 + buf.Len() + 3) / 4
+	if _, _, err := extractAnimationFrame(buf.Bytes(), "image/gif", "dummy", 0, opts); err != nil {
+		t.Fatalf("Expected the GIF to be extracted, got %v", err)
+	}
+}
+
+// buildAPNG assembles an APNG whose frames are the given images, all at the origin.
+func buildAPNG(t *testing.T, frames []*image.RGBA) []byte {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	sequence := uint32(0)
+	for i, frame := range frames {
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, frame); err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := readPNGChunks(encoded.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			writePNGChunk(&out, "IHDR", chunks[0].Data)
+			actl := make([]byte, 8)
+			binary.BigEndian.PutUint32(actl, uint32(len(frames)))
+			writePNGChunk(&out, "acTL", actl)
+		}
+
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(frame.Bounds().Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(frame.Bounds().Dy()))
+		writePNGChunk(&out, "fcTL", fctl)
+		sequence++
+
+		for _, chunk := range chunks {
+			if chunk.Type != "IDAT" {
+				continue
+			}
+			if i == 0 {
+				writePNGChunk(&out, "IDAT", chunk.Data)
+			} else {
+				fdat := make([]byte, 4+len(chunk.Data))
+				binary.BigEndian.PutUint32(fdat, sequence)
+				copy(fdat[4:], chunk.Data)
+				writePNGChunk(&out, "fdAT", fdat)
+				sequence++
+			}
+		}
+	}
+
+	writePNGChunk(&out, "IEND", nil)
+	return out.Bytes()
+}
+
+func Test_APNG_frames(t *testing.T) {
+	data := buildAPNG(t, []*image.RGBA{
+		solidImage(testFrameColors[0], 4, 4),
+		solidImage(testFrameColors[1], 2, 2),
+	})
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	result, maxIndex, err := extractAnimationFrame(data, "image/png", "dummy", 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxIndex != 1 {
+		t.Fatalf("Expected max index 1, got %d", maxIndex)
+	}
+
+	img := decodeExtractedFrame(t, result)
+	assertColor(t, img, 0, 0, testFrameColors[1])
+	assertColor(t, img, 3, 3, testFrameColors[0])
+}
+
+func Test_APNG_frame_outside_canvas(t *testing.T) {
+	data := buildAPNG(t, []*image.RGBA{
+		solidImage(testFrameColors[0], 4, 4),
+		solidImage(testFrameColors[1], 8, 2),
+	})
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	if _, _, err := extractAnimationFrame(data, "image/png", "dummy", 0, opts); err != errInvalidAnimation {
+		t.Fatalf("Expected a frame wider than the canvas to be rejected, got %v", err)
+	}
+}
+
+func Test_static_PNG_single_frame(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, solidImage(testFrameColors[2], 3, 3))
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	result, maxIndex, err := extractAnimationFrame(buf.Bytes(), "image/png", "dummy", 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxIndex != 0 {
+		t.Fatalf("Expected max index 0, got %d", maxIndex)
+	}
+	assertColor(t, decodeExtractedFrame(t, result), 1, 1, testFrameColors[2])
+}
+
+func Test_APNG_too_many_frames(t *testing.T) {
+	frames := make([]*image.RGBA, 65)
+	for i := range frames {
+		frames[i] = solidImage(testFrameColors[0], 1, 1)
+	}
+	data := buildAPNG(t, frames)
+	// Tiny frames on a big canvas, which is composited at full size
+	ihdr := data[len(pngSignature)+8:]
+	binary.BigEndian.PutUint32(ihdr[0:], 2048)
+	binary.BigEndian.PutUint32(ihdr[4:], 2048)
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	if _, _, err := extractAnimationFrame(data, "image/png", "dummy", 0, opts); err != errTooManyFrames {
+		t.Fatalf("Expected the APNG to be rejected, got %v", err)
+	}
+}
+
+// buildWebP assembles a WebP from the given chunks, without encoding any image data.
+func buildWebP(chunks ...webpChunk) []byte {
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		writeWebPChunk(&body, chunk.FourCC, chunk.Data)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+body.Len()))
+	buf.WriteString("WEBP")
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func webpVP8X(width int, height int) webpChunk {
+	data := make([]byte, 10)
+	data[0] = 1 << 1 // animation
+	putUint24(data[4:], width-1)
+	putUint24(data[7:], height-1)
+	return webpChunk{"VP8X", data}
+}
+
+func webpANMF(x int, y int, width int, height int) webpChunk {
+	data := make([]byte, 16)
+	putUint24(data[0:], x/2)
+	putUint24(data[3:], y/2)
+	putUint24(data[6:], width-1)
+	putUint24(data[9:], height-1)
+	return webpChunk{"ANMF", data}
+}
+
+func Test_WebP_invalid_frames(t *testing.T) {
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	for name, data := range map[string][]byte{
+		"ANMF without VP8X":       buildWebP(webpANMF(0, 0, 4, 4)),
+		"ANMF before VP8X":        buildWebP(webpANMF(0, 0, 4, 4), webpVP8X(4, 4)),
+		"ANMF outside canvas":     buildWebP(webpVP8X(4, 4), webpANMF(2, 0, 4, 4)),
+		"ANMF taller than canvas": buildWebP(webpVP8X(4, 4), webpANMF(0, 0, 4, 5)),
+	} {
+		if _, _, err := extractAnimationFrame(data, "image/webp", "dummy", 0, opts); err != errInvalidAnimation {
+			t.Fatalf("Expected %s to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func Test_WebP_too_many_frames(t *testing.T) {
+	chunks := []webpChunk{webpVP8X(2048, 2048)}
+	for i := 0; i < 65; i++ {
+		chunks = append(chunks, webpANMF(0, 0, 1, 1))
+	}
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	if _, _, err := extractAnimationFrame(buildWebP(chunks...), "image/webp", "dummy", 0, opts); err != errTooManyFrames {
+		t.Fatalf("Expected the WebP to be rejected, got %v", err)
+	}
+}
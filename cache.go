@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Cache stores downloaded sources and processing results. Keys are filesystem-safe strings, e.g.
+// those returned by getIndexCacheKey.
+type Cache interface {
+	// Get returns the data stored at key, or errCacheMiss if there's none or it has expired.
+	Get(key string) ([]byte, error)
+	// Put stores data at key for ttl, or indefinitely if ttl is 0.
+	Put(key string, data []byte, ttl time.Duration) error
+	Has(key string) bool
+	Delete(key string) error
+	// Stat returns the metadata of the entry at key, or errCacheMiss if there's none or it has
+	// expired.
+	Stat(key string) (cacheEntryInfo, error)
+	// Keys returns the keys of the entries starting with prefix, which may include expired ones.
+	Keys(prefix string) ([]string, error)
+	// Stats returns how many entries there are and how big they are.
+	Stats() (cacheStats, error)
+}
+
+var errCacheMiss = errors.New("Cache miss")
+
+// cacheStats describes the contents of a cache, and how often lookups found what they were
+// looking for if it keeps count.
+type cacheStats struct {
+	Entries int64 `json:"entries"`
+	Size    int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// HitRatio returns the fraction of lookups which were hits, or 0 if there were none.
+func (s cacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// countingCache counts the hits and misses of lookups in the cache it wraps. Only lookups of
+// contents and outputs count, not those of what's remembered about sources to find them.
+type countingCache struct {
+	Cache
+	hits   int64
+	misses int64
+}
+
+func (c *countingCache) Get(key string) ([]byte, error) {
+	data, err := c.Cache.Get(key)
+	if isSourceInfoCacheKey(key) || isSourceURLCacheKey(key) {
+		return data, err
+	}
+	if err == nil {
+		atomic.AddInt64(&c.hits, 1)
+	} else if err == errCacheMiss {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return data, err
+}
+
+func (c *countingCache) Stats() (cacheStats, error) {
+	stats, err := c.Cache.Stats()
+	stats.Hits, stats.Misses = atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+	return stats, err
+}
+
+// cacheEntryInfo is the metadata stored with each cache entry.
+type cacheEntryInfo struct {
+	Size    int64
+	Created time.Time
+	Expires time.Time // zero if the entry doesn't expire
+}
+
+func newCacheEntryInfo(size int, ttl time.Duration) cacheEntryInfo {
+	info := cacheEntryInfo{Size: int64(size), Created: time.Now()}
+	if ttl > 0 {
+		info.Expires = info.Created.Add(ttl)
+	}
+	return info
+}
+
+func (i cacheEntryInfo) expired() bool {
+	return !i.Expires.IsZero() && time.Now().After(i.Expires)
+}
+
+// Backends which store entries as bytes prefix them with a header holding their creation and
+// expiry times, as Unix nanoseconds.
+const cacheEntryHeaderSize = 16
+
+var errInvalidCacheEntry = errors.New("Invalid cache entry")
+
+func encodeCacheEntry(data []byte, info cacheEntryInfo) []byte {
+	entry := make([]byte, cacheEntryHeaderSize+len(data))
+	binary.BigEndian.PutUint64(entry[0:], uint64(info.Created.UnixNano()))
+	if !info.Expires.IsZero() {
+		binary.BigEndian.PutUint64(entry[8:], uint64(info.Expires.UnixNano()))
+	}
+	copy(entry[cacheEntryHeaderSize:], data)
+	return entry
+}
+
+// decodeCacheEntryHeader returns the metadata of an entry from its header, given the size of the
+// whole entry.
+func decodeCacheEntryHeader(header []byte, entrySize int64) (cacheEntryInfo, error) {
+	if len(header) < cacheEntryHeaderSize || entrySize < cacheEntryHeaderSize {
+		return cacheEntryInfo{}, errInvalidCacheEntry
+	}
+
+	info := cacheEntryInfo{
+		Size:    entrySize - cacheEntryHeaderSize,
+		Created: time.Unix(0, int64(binary.BigEndian.Uint64(header[0:]))),
+	}
+	if expires := int64(binary.BigEndian.Uint64(header[8:])); expires != 0 {
+		info.Expires = time.Unix(0, expires)
+	}
+	return info, nil
+}
+
+func decodeCacheEntry(entry []byte) ([]byte, cacheEntryInfo, error) {
+	info, err := decodeCacheEntryHeader(entry, int64(len(entry)))
+	if err != nil {
+		return nil, info, err
+	}
+	return entry[cacheEntryHeaderSize:], info, nil
+}
+
+// Map from FARSPARK_CACHE_BACKEND value to a constructor for the cache it selects.
+var cacheBackends = map[string]func() (Cache, error){
+	"disk": func() (Cache, error) {
+		c, err := newDiskCache(conf.CacheRoot, conf.CacheSize, int64(conf.CacheDiskSize))
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	},
+	"memory": func() (Cache, error) { return newMemoryCache(int64(conf.CacheSize)), nil },
+	"redis": func() (Cache, error) {
+		c, err := newRedisCache(conf.CacheRedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	},
+}
+
+// newCache returns the configured cache, or nil if caching is disabled. The disk and memory
+// backends are disabled by a zero FARSPARK_CACHE_SIZE.
+func newCache() (Cache, error) {
+	newBackend, ok := cacheBackends[conf.CacheBackend]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cache backend: %s", conf.CacheBackend)
+	}
+
+	if conf.CacheBackend != "redis" && conf.CacheSize <= 0 {
+		return nil, nil
+	}
+
+	cache, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+	return &countingCache{Cache: cache}, nil
+}
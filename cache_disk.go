@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/diskv"
+)
+
+// Directory under the cache root which entries are written to before being moved into place, so
+// entries are never seen half-written, even after a crash.
+const diskCacheTempDir = ".tmp"
+
+// File marking a directory as the root of a disk cache. Files are only ever deleted from
+// directories which have it, so a misconfigured root can't lose anything else.
+const diskCacheSentinel = ".farspark-cache"
+
+// Names of the files and shard directories the cache creates; keys are base64url with separators.
+var (
+	diskCacheKeyFormat   = regexp.MustCompile(`^[A-Za-z0-9_=.-]{4,}$`)
+	diskCacheShardFormat = regexp.MustCompile(`^[A-Za-z0-9_=-]{2}$`)
+
+	// Entries of versions which stored them unsharded in the root, named by the padded base64url
+	// of a SHA-256 hash
+	legacyDiskCacheKeyFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{43}=$`)
+)
+
+type diskCacheEntry struct {
+	key  string
+	size int64 // of the file, including the entry header
+}
+
+// diskCache stores entries as files under a root directory, sharded into two levels of
+// subdirectories by the start of their keys so no directory grows too big. It keeps an index of
+// the files in memory, rebuilt from the directory on startup, and deletes the least recently used
+// ones once they take up more than maxSize bytes. Files are touched when they're read, so their
+// modification times survive restarts as access times.
+type diskCache struct {
+	root    string
+	d       *diskv.Diskv
+	maxSize int64 // 0 for no limit
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List // of *diskCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+func shardCacheKey(key string) []string {
+	if len(key) < 4 {
+		return []string{}
+	}
+	return []string{key[0:2], key[2:4]}
+}
+
+// newDiskCache returns a cache storing up to maxSize bytes of entries under root, or any amount
+// if maxSize is 0, and keeping up to memorySize bytes of them in memory too. Entries already under
+// root are kept. root must be missing, empty, or the root of an earlier disk cache.
+func newDiskCache(root string, memorySize int, maxSize int64) (*diskCache, error) {
+	if err := claimDiskCacheRoot(root); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{
+		root: root,
+		d: diskv.New(diskv.Options{
+			BasePath:     root,
+			TempDir:      filepath.Join(root, diskCacheTempDir),
+			Transform:    shardCacheKey,
+			CacheSizeMax: uint64(memorySize),
+		}),
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// claimDiskCacheRoot creates root and marks it as a disk cache's if it's missing or empty, or only
+// holds entries of versions which didn't shard it, which are deleted. Any other directory is
+// refused unless it's marked already.
+func claimDiskCacheRoot(root string) error {
+	if len(root) == 0 {
+		return errors.New("FARSPARK_CACHE_ROOT must be set for the disk cache")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+
+	sentinel := filepath.Join(root, diskCacheSentinel)
+	if _, err := os.Stat(sentinel); err == nil {
+		return nil
+	}
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !legacyDiskCacheKeyFormat.MatchString(file.Name()) {
+			return fmt.Errorf("Cache root %s holds files which weren't written by farspark; empty it or create %s in it", root, diskCacheSentinel)
+		}
+	}
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(root, file.Name())); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(sentinel, nil, 0600)
+}
+
+// loadIndex indexes the entries under the root by their modification times, and deletes files
+// in the shard directories which are left over from writes which never finished, or from older
+// versions which stored entries elsewhere, without a header. Anything else is left alone.
+func (c *diskCache) loadIndex() error {
+	os.RemoveAll(filepath.Join(c.root, diskCacheTempDir))
+
+	type file struct {
+		diskCacheEntry
+		modified time.Time
+	}
+	var files []file
+
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(c.root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		depth := len(strings.Split(rel, string(filepath.Separator)))
+
+		if info.IsDir() {
+			if depth > 2 || !diskCacheShardFormat.MatchString(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if depth != 3 || !info.Mode().IsRegular() || !diskCacheKeyFormat.MatchString(info.Name()) {
+			return nil
+		}
+		if info.Size() < cacheEntryHeaderSize || path != c.path(info.Name()) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, file{diskCacheEntry{info.Name(), info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range files {
+		c.entries[files[i].key] = c.lru.PushFront(&files[i].diskCacheEntry)
+		c.size += files[i].size
+	}
+	c.evict()
+	return nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(append(append([]string{c.root}, shardCacheKey(key)...), key)...)
+}
+
+// track indexes the entry at key as the most recently used, and evicts others if it takes the
+// cache over its maximum size.
+func (c *diskCache) track(key string, size int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&diskCacheEntry{key, size})
+	c.size += size
+	c.evict()
+}
+
+// touch marks the entry at key as used.
+func (c *diskCache) touch(key string) {
+	c.mutex.Lock()
+	element, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		now := time.Now()
+		os.Chtimes(c.path(key), now, now)
+	}
+}
+
+func (c *diskCache) untrack(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// remove removes an entry from the index. The cache must be locked.
+func (c *diskCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*diskCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// evict deletes the least recently used entries until the cache is within its maximum size. The
+// cache must be locked.
+func (c *diskCache) evict() {
+	for c.maxSize > 0 && c.size > c.maxSize && c.lru.Len() > 0 {
+		element := c.lru.Back()
+		c.d.Erase(element.Value.(*diskCacheEntry).key)
+		c.remove(element)
+	}
+}
+
+func (c *diskCache) Get(key string) ([]byte, error) {
+	entry, err := c.d.Read(key)
+	if os.IsNotExist(err) {
+		c.untrack(key)
+		return nil, errCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, info, err := decodeCacheEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if info.expired() {
+		c.Delete(key)
+		return nil, errCacheMiss
+	}
+
+	c.touch(key)
+	return data, nil
+}
+
+func (c *diskCache) Put(key string, data []byte, ttl time.Duration) error {
+	entry := encodeCacheEntry(data, newCacheEntryInfo(len(data), ttl))
+
+	// Entries which would evict everything else aren't worth keeping
+	if c.maxSize > 0 && int64(len(entry)) > c.maxSize {
+		return c.Delete(key)
+	}
+
+	if err := c.d.WriteStream(key, bytes.NewReader(entry), true); err != nil {
+		return err
+	}
+	c.track(key, int64(len(entry)))
+	return nil
+}
+
+func (c *diskCache) Has(key string) bool {
+	_, err := c.Stat(key)
+	return err == nil
+}
+
+func (c *diskCache) Delete(key string) error {
+	c.untrack(key)
+	if err := c.d.Erase(key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *diskCache) Stat(key string) (cacheEntryInfo, error) {
+	file, err := os.Open(c.path(key))
+	if os.IsNotExist(err) {
+		return cacheEntryInfo{}, errCacheMiss
+	} else if err != nil {
+		return cacheEntryInfo{}, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return cacheEntryInfo{}, err
+	}
+
+	header := make([]byte, cacheEntryHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return cacheEntryInfo{}, errInvalidCacheEntry
+	}
+
+	info, err := decodeCacheEntryHeader(header, fileInfo.Size())
+	if err != nil {
+		return info, err
+	}
+	if info.expired() {
+		return info, errCacheMiss
+	}
+	return info, nil
+}
+
+func (c *diskCache) Keys(prefix string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var keys []string
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *diskCache) Stats() (cacheStats, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := int64(len(c.entries))
+	return cacheStats{Entries: entries, Size: c.size - entries*cacheEntryHeaderSize}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryCacheEntry struct {
+	key  string
+	data []byte
+	info cacheEntryInfo
+}
+
+// memoryCache keeps entries in memory, evicting the least recently used ones once they take up
+// more than maxSize bytes.
+type memoryCache struct {
+	mutex   sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List // of *memoryCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the live entry at key, marking it as used. The cache must be locked.
+func (c *memoryCache) lookup(key string) (*memoryCacheEntry, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if entry.info.expired() {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+// remove removes an entry. The cache must be locked.
+func (c *memoryCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.info.Size
+}
+
+func (c *memoryCache) Get(key string) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok {
+		return nil, errCacheMiss
+	}
+	return entry.data, nil
+}
+
+func (c *memoryCache) Put(key string, data []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	// Entries which would evict everything else aren't worth keeping
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+
+	entry := &memoryCacheEntry{key, data, newCacheEntryInfo(len(data), ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.info.Size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) Has(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.lookup(key)
+	return ok
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	return nil
+}
+
+func (c *memoryCache) Stat(key string) (cacheEntryInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.lookup(key)
+	if !ok {
+		return cacheEntryInfo{}, errCacheMiss
+	}
+	return entry.info, nil
+}
+
+func (c *memoryCache) Keys(prefix string) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var keys []string
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *memoryCache) Stats() (cacheStats, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return cacheStats{Entries: int64(len(c.entries)), Size: c.size}, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a Redis command may take, including connecting.
+const redisTimeout = 5 * time.Second
+
+// How many idle connections to Redis are kept open.
+const redisMaxIdleConns = 8
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply from Redis. It doesn't mean the connection is broken.
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis error: " + string(e)
+}
+
+// redisCache stores entries in Redis, or anything else speaking its protocol, expiring them with
+// Redis's own TTLs.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// newRedisCache returns a cache for the Redis server at a URL like
+// redis://:password@localhost:6379/0.
+func newRedisCache(redisURL string) (*redisCache, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil || u.Scheme != "redis" || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("Invalid Redis URL: %s", redisURL)
+	}
+
+	c := &redisCache{addr: u.Host, idle: make(chan *redisConn, redisMaxIdleConns)}
+	if len(u.Port()) == 0 {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid Redis database: %s", db)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisCache) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn, bufio.NewReader(conn)}
+
+	if len(c.password) > 0 {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// do sends a command to Redis and returns its reply, which is nil, an int64, a string, a []byte
+// or an []interface{} of those.
+func (c *redisCache) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, command); err != nil {
+		return nil, err
+	}
+
+	return readRESP(rc.reader)
+}
+
+// readRESP reads a reply in the Redis serialization protocol.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("Invalid Redis reply")
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			if elements[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	default:
+		return nil, errors.New("Invalid Redis reply")
+	}
+}
+
+func (c *redisCache) Get(key string) ([]byte, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := reply.([]byte)
+	if !ok {
+		return nil, errCacheMiss
+	}
+
+	data, info, err := decodeCacheEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if info.expired() {
+		return nil, errCacheMiss
+	}
+	return data, nil
+}
+
+func (c *redisCache) Put(key string, data []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(encodeCacheEntry(data, newCacheEntryInfo(len(data), ttl)))}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisCache) Has(key string) bool {
+	reply, err := c.do("EXISTS", key)
+	return err == nil && reply == int64(1)
+}
+
+func (c *redisCache) Delete(key string) error {
+	_, err := c.do("DEL", key)
+	return err
+}
+
+func (c *redisCache) Stat(key string) (cacheEntryInfo, error) {
+	reply, err := c.do("STRLEN", key)
+	if err != nil {
+		return cacheEntryInfo{}, err
+	}
+	size, _ := reply.(int64)
+	if size == 0 {
+		return cacheEntryInfo{}, errCacheMiss
+	}
+
+	if reply, err = c.do("GETRANGE", key, "0", strconv.Itoa(cacheEntryHeaderSize-1)); err != nil {
+		return cacheEntryInfo{}, err
+	}
+	header, _ := reply.([]byte)
+
+	info, err := decodeCacheEntryHeader(header, size)
+	if err != nil {
+		return info, err
+	}
+	if info.expired() {
+		return info, errCacheMiss
+	}
+	return info, nil
+}
+
+// Escapes the characters which are special in Redis's glob-style patterns.
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *redisCache) Keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", redisPatternEscaper.Replace(prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, errors.New("Invalid Redis reply")
+		}
+		next, _ := parts[0].([]byte)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if key, ok := key.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+
+		if cursor = string(next); cursor == "0" || len(cursor) == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// Stats returns the number of keys in the database, and the memory Redis uses in total, since
+// the size of the entries themselves isn't known without reading every one of them.
+func (c *redisCache) Stats() (cacheStats, error) {
+	var stats cacheStats
+
+	reply, err := c.do("DBSIZE")
+	if err != nil {
+		return stats, err
+	}
+	stats.Entries, _ = reply.(int64)
+
+	if reply, err = c.do("INFO", "memory"); err != nil {
+		return stats, err
+	}
+	info, _ := reply.([]byte)
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			stats.Size, _ = strconv.ParseInt(line[len("used_memory:"):], 10, 64)
+		}
+	}
+	return stats, nil
+}
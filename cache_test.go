@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testCacheBackend(t *testing.T, cache Cache) {
+	if _, err := cache.Get("missing"); err != errCacheMiss {
+		t.Fatalf("Expected a miss, got %v", err)
+	}
+	if cache.Has("missing") {
+		t.Fatal("Expected missing entry not to exist")
+	}
+
+	if err := cache.Put("abcdef", []byte("contents"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get("abcdef"); err != nil || string(data) != "contents" {
+		t.Fatalf("Expected stored contents, got %q, %v", data, err)
+	}
+	if !cache.Has("abcdef") {
+		t.Fatal("Expected stored entry to exist")
+	}
+	info, err := cache.Stat("abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 8 || !info.Expires.IsZero() || time.Since(info.Created) > time.Minute {
+		t.Fatalf("Unexpected entry info %+v", info)
+	}
+
+	if err := cache.Delete("abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Has("abcdef") {
+		t.Fatal("Expected deleted entry not to exist")
+	}
+	if err := cache.Delete("abcdef"); err != nil {
+		t.Fatalf("Expected deleting a missing entry to succeed, got %v", err)
+	}
+
+	if err := cache.Put("expiring", []byte("contents"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := cache.Stat("expiring"); err != nil || info.Expires.IsZero() {
+		t.Fatalf("Expected entry with an expiry, got %+v, %v", info, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cache.Get("expiring"); err != errCacheMiss {
+		t.Fatalf("Expected expired entry to miss, got %v", err)
+	}
+
+	for _, key := range []string{"abcd.1", "abcd.2", "abce.1"} {
+		cache.Put(key, []byte("contents"), 0)
+	}
+	keys, err := cache.Keys("abcd.")
+	sort.Strings(keys)
+	if err != nil || strings.Join(keys, ",") != "abcd.1,abcd.2" {
+		t.Fatalf("Expected the keys with the prefix, got %v, %v", keys, err)
+	}
+	if stats, err := cache.Stats(); err != nil || stats.Entries != 3 || stats.Size < 24 {
+		t.Fatalf("Unexpected stats %+v, %v", stats, err)
+	}
+}
+
+func Test_disk_cache(t *testing.T) {
+	root, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := newDiskCache(root, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCacheBackend(t, cache)
+
+	cache.Put("abcdef", []byte("contents"), 0)
+	if _, err := os.Stat(filepath.Join(root, "ab", "cd", "abcdef")); err != nil {
+		t.Fatalf("Expected entry to be stored in a sharded directory: %v", err)
+	}
+}
+
+func Test_disk_cache_eviction(t *testing.T) {
+	root, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Room for three entries of 4 bytes
+	maxSize := int64(3 * (cacheEntryHeaderSize + 4))
+	cache, err := newDiskCache(root, 0, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"aaaa", "bbbb", "cccc"} {
+		cache.Put(key, []byte("1234"), 0)
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.Get("aaaa")
+	cache.Put("dddd", []byte("1234"), 0)
+
+	if !cache.Has("aaaa") || cache.Has("bbbb") || !cache.Has("cccc") || !cache.Has("dddd") {
+		t.Fatal("Expected the least recently used entry to be evicted")
+	}
+	if _, err := os.Stat(cache.path("bbbb")); !os.IsNotExist(err) {
+		t.Fatal("Expected the evicted entry's file to be deleted")
+	}
+
+	// Leftovers of writes which never finished
+	os.MkdirAll(filepath.Join(root, diskCacheTempDir), 0700)
+	ioutil.WriteFile(filepath.Join(root, diskCacheTempDir, "partial"), []byte("12"), 0600)
+	ioutil.WriteFile(cache.path("eeee"), []byte("12"), 0600)
+
+	// The index is rebuilt on startup, with the order the entries were used in
+	cache, err = newDiskCache(root, 0, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := cache.Stats(); stats.Entries != 3 || stats.Size != 12 {
+		t.Fatalf("Expected the existing entries to be indexed, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(root, diskCacheTempDir)); !os.IsNotExist(err) {
+		t.Fatal("Expected leftover temporary files to be deleted")
+	}
+	cache.Put("ffff", []byte("1234"), 0)
+	if cache.Has("cccc") || !cache.Has("aaaa") || !cache.Has("dddd") || !cache.Has("ffff") {
+		t.Fatal("Expected the least recently used entry to be evicted after a restart")
+	}
+}
+
+func Test_disk_cache_leaves_other_files(t *testing.T) {
+	root, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err := newDiskCache(root, 0, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files which aren't entries of this layout are left alone, unless they're in a shard
+	// directory and named like an entry
+	flat := filepath.Join(root, "ZmFyc3BhcmsgZmxhdCBlbnRyeQ")
+	if err := ioutil.WriteFile(flat, []byte("%PDF-1.4 stored before sharding"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "ab", "cd"), 0700)
+	misplaced := filepath.Join(root, "ab", "cd", "efgh")
+	ioutil.WriteFile(misplaced, []byte("%PDF-1.4 in the wrong shard"), 0600)
+	notes := filepath.Join(root, "ab", "cd", "notes.txt~")
+	ioutil.WriteFile(notes, []byte("x"), 0600)
+	os.MkdirAll(filepath.Join(root, "other"), 0700)
+	other := filepath.Join(root, "other", "file")
+	ioutil.WriteFile(other, []byte("x"), 0600)
+
+	cache, err := newDiskCache(root, 0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("Expected files outside the sharded layout not to be indexed, got %+v", stats)
+	}
+	if _, err := os.Stat(misplaced); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be deleted", misplaced)
+	}
+	for _, path := range []string{flat, notes, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("Expected %s to be kept: %v", path, err)
+		}
+	}
+
+	cache.Put("abcdef", []byte("contents"), 0)
+	if data, err := cache.Get("abcdef"); err != nil || string(data) != "contents" {
+		t.Fatalf("Expected new entries to be stored, got %q, %v", data, err)
+	}
+}
+
+func Test_disk_cache_legacy_root(t *testing.T) {
+	root, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Entries of versions which didn't shard the root, without a header or sentinel
+	legacy := []string{
+		filepath.Join(root, "n4bQgYhMfWWaL-qgxVrQFaO_TxsrC4Is0V1sFbDwCgg="),
+		filepath.Join(root, "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU="),
+	}
+	for _, path := range legacy {
+		if err := ioutil.WriteFile(path, []byte("%PDF-1.4 stored before sharding"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache, err := newDiskCache(root, 0, 1024)
+	if err != nil {
+		t.Fatalf("Expected a root of legacy entries to be migrated, got %v", err)
+	}
+	for _, path := range legacy {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected legacy entry %s to be deleted", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, diskCacheSentinel)); err != nil {
+		t.Fatalf("Expected the migrated root to be marked: %v", err)
+	}
+	if stats, _ := cache.Stats(); stats.Entries != 0 {
+		t.Fatalf("Expected legacy entries not to be indexed, got %+v", stats)
+	}
+
+	// Legacy entries alongside anything else aren't touched
+	mixed, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mixed)
+	mixedLegacy := filepath.Join(mixed, filepath.Base(legacy[0]))
+	ioutil.WriteFile(mixedLegacy, []byte("legacy"), 0600)
+	ioutil.WriteFile(filepath.Join(mixed, "notes.txt"), []byte("x"), 0600)
+	if _, err := newDiskCache(mixed, 0, 1024); err == nil {
+		t.Fatal("Expected a root with foreign files to be refused")
+	}
+	if _, err := os.Stat(mixedLegacy); err != nil {
+		t.Fatalf("Expected files in a refused root to be kept: %v", err)
+	}
+}
+
+func Test_disk_cache_refuses_unmarked_root(t *testing.T) {
+	root, err := ioutil.TempDir("", "farspark-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	unrelated := filepath.Join(root, "unrelated")
+	ioutil.WriteFile(unrelated, []byte("x"), 0600)
+
+	if _, err := newDiskCache(root, 0, 1024); err == nil {
+		t.Fatal("Expected a non-empty root without a sentinel to be refused")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Fatalf("Expected files in a refused root to be kept: %v", err)
+	}
+	if _, err := newDiskCache("", 0, 1024); err == nil {
+		t.Fatal("Expected an empty root to be refused")
+	}
+
+	fresh := filepath.Join(root, "fresh")
+	if _, err := newDiskCache(fresh, 0, 1024); err != nil {
+		t.Fatalf("Expected a missing root to be created, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fresh, diskCacheSentinel)); err != nil {
+		t.Fatalf("Expected a created root to be marked: %v", err)
+	}
+}
+
+func Test_memory_cache(t *testing.T) {
+	testCacheBackend(t, newMemoryCache(1024))
+}
+
+func Test_memory_cache_eviction(t *testing.T) {
+	cache := newMemoryCache(10)
+	cache.Put("a", []byte("1234"), 0)
+	cache.Put("b", []byte("1234"), 0)
+	cache.Get("a")
+	cache.Put("c", []byte("1234"), 0)
+
+	if !cache.Has("a") || cache.Has("b") || !cache.Has("c") {
+		t.Fatal("Expected the least recently used entry to be evicted")
+	}
+
+	cache.Put("d", []byte("12345678901"), 0)
+	if cache.Has("d") || !cache.Has("a") {
+		t.Fatal("Expected entries bigger than the cache not to be stored")
+	}
+}
+
+// fakeRedis is a Redis stand-in supporting just the commands redisCache uses.
+type fakeRedis struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	password string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, values: map[string]string{}, expires: map[string]time.Time{}, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := len(r.password) == 0
+
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		if !authenticated && strings.ToUpper(args[0]) != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		fmt.Fprint(conn, r.execute(args, &authenticated))
+	}
+}
+
+func (r *fakeRedis) execute(args []string, authenticated *bool) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if expires, ok := r.expires[key]; ok && time.Now().After(expires) {
+			delete(r.values, key)
+			delete(r.expires, key)
+		}
+	}
+	value, exists := r.values[key]
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[1] != r.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authenticated = true
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if !exists {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		r.values[key] = args[2]
+		delete(r.expires, key)
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			r.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "EXISTS", "DEL", "STRLEN":
+		if !exists {
+			return ":0\r\n"
+		}
+		if strings.ToUpper(args[0]) == "DEL" {
+			delete(r.values, key)
+		}
+		if strings.ToUpper(args[0]) == "STRLEN" {
+			return fmt.Sprintf(":%d\r\n", len(value))
+		}
+		return ":1\r\n"
+	case "GETRANGE":
+		start, _ := strconv.Atoi(args[2])
+		end, _ := strconv.Atoi(args[3])
+		if end >= len(value) {
+			end = len(value) - 1
+		}
+		if start > end {
+			return "$0\r\n\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", end-start+1, value[start:end+1])
+	case "SCAN":
+		prefix := strings.Replace(strings.TrimSuffix(args[3], "*"), `\`, "", -1)
+		reply := ""
+		count := 0
+		for key := range r.values {
+			if strings.HasPrefix(key, prefix) {
+				reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+				count++
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", count, reply)
+	case "DBSIZE":
+		return fmt.Sprintf(":%d\r\n", len(r.values))
+	case "INFO":
+		var size int
+		for _, value := range r.values {
+			size += len(value)
+		}
+		info := fmt.Sprintf("# Memory\r\nused_memory:%d\r\n", size)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func Test_redis_cache(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.listener.Close()
+
+	cache, err := newRedisCache(fmt.Sprintf("redis://:secret@%s/1", server.listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCacheBackend(t, cache)
+
+	cache, _ = newRedisCache(fmt.Sprintf("redis://:wrong@%s", server.listener.Addr()))
+	if err := cache.Put("key", []byte("value"), 0); err == nil {
+		t.Fatal("Expected a wrong password to be rejected")
+	}
+}
+
+func Test_redis_cache_URL(t *testing.T) {
+	cache, err := newRedisCache("redis://localhost")
+	if err != nil || cache.addr != "localhost:6379" || cache.db != 0 {
+		t.Fatalf("Expected the default port and database, got %+v, %v", cache, err)
+	}
+
+	for _, invalid := range []string{"http://localhost", "redis://localhost/db", "redis:///0"} {
+		if _, err := newRedisCache(invalid); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+var commands = map[string]func(args []string) error{
+	"sign-thumbnail": signThumbnailCommand,
+}
+
+// runCommand runs the CLI subcommand named by args[0] and returns the process exit code.
+func runCommand(args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		return 2
+	}
+
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+func signThumbnailCommand(args []string) error {
+	flags := flag.NewFlagSet("sign-thumbnail", flag.ContinueOnError)
+	sourceURL := flags.String("url", "", "URL of the source media")
+	width := flags.Int("w", 0, "thumbnail width")
+	height := flags.Int("h", 0, "thumbnail height")
+	maxDimension := flags.Int("max", 0, "scale down to fit within this many pixels instead of using -w and -h")
+	format := flags.String("format", "", "output format, png, jpeg or webp; defaults to the source format")
+	ttl := flags.Duration("ttl", 0, "how long the URL is valid for; 0 means forever")
+	server := flags.String("server", "", "URL of the farspark server; defaults to FARSPARK_SERVER_URL")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*sourceURL) == 0 || *maxDimension <= 0 && (*width <= 0 || *height <= 0) {
+		flags.Usage()
+		return fmt.Errorf("-url, and either -w and -h or -max are required")
+	}
+
+	opts := thumbnailOptions{SourceURL: *sourceURL, Width: *width, Height: *height, MaxDimension: *maxDimension}
+	if *maxDimension > 0 {
+		opts.Width, opts.Height = 0, 0
+	}
+	if len(*format) > 0 {
+		var ok bool
+		if opts.Format, ok = extractFormats[*format]; !ok {
+			return fmt.Errorf("Invalid format: %s", *format)
+		}
+	}
+
+	if len(conf.Keys) == 0 {
+		return fmt.Errorf("FARSPARK_KEY and FARSPARK_SALT must be set to sign URLs")
+	}
+
+	serverURL := conf.ServerURL
+	if len(*server) > 0 {
+		var err error
+		if serverURL, err = url.Parse(*server); err != nil {
+			return err
+		}
+	}
+	if serverURL == nil {
+		serverURL = &url.URL{}
+	}
+
+	var expires time.Time
+	if *ttl > 0 {
+		expires = time.Now().Add(*ttl)
+	}
+
+	thumbnailURL, err := generateThumbnailURL(serverURL, opts, expires)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(thumbnailURL.String())
+	return nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"github.com/peterbourgon/diskv"
 	"log"
+	"net"
 	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 )
@@ -45,6 +47,34 @@ func strSliceEnvConfig(s *[]string, name string) {
 	}
 }
 
+func hexSliceEnvConfig(b *[][]byte, name string) {
+	*b = make([][]byte, 0)
+
+	if env := os.Getenv(name); len(env) > 0 {
+		for _, part := range strings.Split(env, ",") {
+			bin, err := hex.DecodeString(strings.TrimSpace(part))
+			if err != nil {
+				log.Fatalf("%s expected to be a comma-separated list of hex-encoded strings\n", name)
+			}
+			*b = append(*b, bin)
+		}
+	}
+}
+
+func cidrSliceEnvConfig(n *[]*net.IPNet, name string) {
+	*n = make([]*net.IPNet, 0)
+
+	if env := os.Getenv(name); len(env) > 0 {
+		for _, part := range strings.Split(env, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(part))
+			if err != nil {
+				log.Fatalf("%s expected to be a comma-separated list of CIDRs, got %s\n", name, part)
+			}
+			*n = append(*n, network)
+		}
+	}
+}
+
 func boolEnvConfig(b *bool, name string) {
 	*b = false
 	if env, err := strconv.ParseBool(os.Getenv(name)); err == nil {
@@ -63,37 +93,88 @@ type config struct {
 	MaxDimension  int
 	MaxResolution int
 
+	MaxSrcFileSize          int
+	MaxThumbnailSrcFileSize int
+	MaxExtractSrcFileSize   int
+	MaxGLTFSrcFileSize      int
+
 	GZipCompression int
 
 	AllowOrigins []string
 
-	CacheRoot string
-	CacheSize int
+	Keys          [][]byte
+	Salts         [][]byte
+	AllowInsecure bool
+
+	RequireThumbnailSignatures bool
+
+	AllowedNetworks []*net.IPNet
+	AllowedHosts    []string
+
+	AllowedSources []sourcePattern
+	DeniedSources  []sourcePattern
+
+	CacheBackend  string
+	CacheRoot     string
+	CacheSize     int
+	CacheDiskSize int
+	CacheRedisURL string
+	CacheTTL      int
+
+	ThumbnailCacheMaxSize int
+	RawCacheMaxSize       int
 
 	ServerURL *url.URL
+
+	GLTFPatchInPlace bool
+
+	SubresourceURLTTL int
+
+	FFmpegPath string
+
+	OfficeConverterPath    string
+	OfficeConverterArgs    string
+	OfficeConverterTimeout int
+
+	GhostscriptPath  string
+	PDFConcurrency   int
+	PDFRenderTimeout int
+
+	PDFPrerenderPages       int
+	PDFPrerenderConcurrency int
+
+	AdminToken string
 }
 
 var conf = config{
-	Bind:             ":8080",
-	ReadTimeout:      10,
-	WriteTimeout:     10,
-	DownloadTimeout:  5,
-	TTL:              3600,
-	MaxDimension:     2048,
-	GZipCompression:  5,
+	Bind:                ":8080",
+	ReadTimeout:         10,
+	WriteTimeout:        10,
+	DownloadTimeout:     5,
+	TTL:                 3600,
+	MaxDimension:        2048,
+	MaxResolution:       16800000,
+	MaxSrcFileSize:      100 * 1024 * 1024,
+	GZipCompression:     5,
+	OfficeConverterArgs: defaultOfficeConverterArgs,
+	FFmpegPath:          "ffmpeg",
+	GhostscriptPath:     "gs",
+	PDFRenderTimeout:    10,
+	CacheBackend:        "disk",
+	CacheDiskSize:       1024 * 1024 * 1024,
+	CacheTTL:            3600,
+
+	ThumbnailCacheMaxSize:  1024 * 1024,
+	PDFPrerenderPages:      50,
+	OfficeConverterTimeout: 60,
 }
 
-var farsparkCache *diskv.Diskv
+var farsparkCache Cache
 
 func initCache() {
-	if conf.CacheSize > 0 {
-		farsparkCache = diskv.New(diskv.Options{
-			BasePath:     conf.CacheRoot,
-			Transform:    func(s string) []string { return []string{} },
-			CacheSizeMax: uint64(conf.CacheSize),
-		})
-	} else {
-		farsparkCache = nil
+	var err error
+	if farsparkCache, err = newCache(); err != nil {
+		log.Fatalln(err)
 	}
 }
 
@@ -112,15 +193,61 @@ func init() {
 	intEnvConfig(&conf.TTL, "FARSPARK_TTL")
 
 	intEnvConfig(&conf.MaxDimension, "FARSPARK_MAX_DIMENSION")
+	megaIntEnvConfig(&conf.MaxResolution, "FARSPARK_MAX_SRC_RESOLUTION")
+
+	intEnvConfig(&conf.MaxSrcFileSize, "FARSPARK_MAX_SRC_FILE_SIZE")
+	conf.MaxThumbnailSrcFileSize = conf.MaxSrcFileSize
+	conf.MaxExtractSrcFileSize = conf.MaxSrcFileSize
+	conf.MaxGLTFSrcFileSize = conf.MaxSrcFileSize
+	intEnvConfig(&conf.MaxThumbnailSrcFileSize, "FARSPARK_MAX_THUMBNAIL_SRC_FILE_SIZE")
+	intEnvConfig(&conf.MaxExtractSrcFileSize, "FARSPARK_MAX_EXTRACT_SRC_FILE_SIZE")
+	intEnvConfig(&conf.MaxGLTFSrcFileSize, "FARSPARK_MAX_GLTF_SRC_FILE_SIZE")
 
 	intEnvConfig(&conf.GZipCompression, "FARSPARK_GZIP_COMPRESSION")
 
 	strSliceEnvConfig(&conf.AllowOrigins, "FARSPARK_ALLOW_ORIGINS")
 
+	hexSliceEnvConfig(&conf.Keys, "FARSPARK_KEY")
+	hexSliceEnvConfig(&conf.Salts, "FARSPARK_SALT")
+	boolEnvConfig(&conf.AllowInsecure, "FARSPARK_ALLOW_INSECURE")
+	boolEnvConfig(&conf.RequireThumbnailSignatures, "FARSPARK_REQUIRE_THUMBNAIL_SIGNATURES")
+
+	cidrSliceEnvConfig(&conf.AllowedNetworks, "FARSPARK_ALLOWED_NETWORKS")
+	strSliceEnvConfig(&conf.AllowedHosts, "FARSPARK_ALLOWED_HOSTS")
+
+	var allowedSources, deniedSources []string
+	strSliceEnvConfig(&allowedSources, "FARSPARK_ALLOWED_SOURCES")
+	strSliceEnvConfig(&deniedSources, "FARSPARK_DENIED_SOURCES")
+	conf.AllowedSources = parseSourcePatterns(allowedSources)
+	conf.DeniedSources = parseSourcePatterns(deniedSources)
+
 	strEnvConfig(&conf.CacheRoot, "FARSPARK_CACHE_ROOT")
 	intEnvConfig(&conf.CacheSize, "FARSPARK_CACHE_SIZE")
+	intEnvConfig(&conf.CacheDiskSize, "FARSPARK_CACHE_DISK_SIZE")
+	strEnvConfig(&conf.CacheBackend, "FARSPARK_CACHE_BACKEND")
+	strEnvConfig(&conf.CacheRedisURL, "FARSPARK_CACHE_REDIS_URL")
+	intEnvConfig(&conf.CacheTTL, "FARSPARK_CACHE_TTL")
+	intEnvConfig(&conf.ThumbnailCacheMaxSize, "FARSPARK_THUMBNAIL_CACHE_MAX_SIZE")
+	intEnvConfig(&conf.RawCacheMaxSize, "FARSPARK_RAW_CACHE_MAX_SIZE")
 
 	urlEnvConfig(&conf.ServerURL, "FARSPARK_SERVER_URL")
+	boolEnvConfig(&conf.GLTFPatchInPlace, "FARSPARK_GLTF_PATCH_IN_PLACE")
+	intEnvConfig(&conf.SubresourceURLTTL, "FARSPARK_SUBRESOURCE_URL_TTL")
+
+	strEnvConfig(&conf.FFmpegPath, "FARSPARK_FFMPEG_PATH")
+
+	strEnvConfig(&conf.OfficeConverterPath, "FARSPARK_OFFICE_CONVERTER")
+	strEnvConfig(&conf.OfficeConverterArgs, "FARSPARK_OFFICE_CONVERTER_ARGS")
+	intEnvConfig(&conf.OfficeConverterTimeout, "FARSPARK_OFFICE_CONVERTER_TIMEOUT")
+
+	strEnvConfig(&conf.GhostscriptPath, "FARSPARK_GS_PATH")
+	conf.PDFConcurrency = runtime.NumCPU()
+	intEnvConfig(&conf.PDFConcurrency, "FARSPARK_PDF_CONCURRENCY")
+	intEnvConfig(&conf.PDFRenderTimeout, "FARSPARK_PDF_RENDER_TIMEOUT")
+	intEnvConfig(&conf.PDFPrerenderPages, "FARSPARK_PDF_PRERENDER_PAGES")
+	intEnvConfig(&conf.PDFPrerenderConcurrency, "FARSPARK_PDF_PRERENDER_CONCURRENCY")
+
+	strEnvConfig(&conf.AdminToken, "FARSPARK_ADMIN_TOKEN")
 
 	if len(conf.Bind) == 0 {
 		log.Fatalln("Bind address is not defined")
@@ -146,12 +273,70 @@ func init() {
 		log.Fatalf("Max dimension should be greater than 0, now - %d\n", conf.MaxDimension)
 	}
 
+	if conf.MaxResolution <= 0 {
+		log.Fatalf("Max resolution should be greater than 0, now - %d\n", conf.MaxResolution)
+	}
+
+	if len(conf.Keys) != len(conf.Salts) {
+		log.Fatalf("Number of keys and salts should be equal, now - %d keys and %d salts\n", len(conf.Keys), len(conf.Salts))
+	}
+
+	if len(conf.Keys) == 0 && !conf.AllowInsecure {
+		log.Println("No keys defined, so signature checking is disabled")
+		conf.AllowInsecure = true
+	}
+
+	if conf.MaxSrcFileSize < 0 || conf.MaxThumbnailSrcFileSize < 0 || conf.MaxExtractSrcFileSize < 0 || conf.MaxGLTFSrcFileSize < 0 {
+		log.Fatalln("Max src file sizes should be greater than or equal to 0")
+	}
+
+	if conf.CacheDiskSize < 0 {
+		log.Fatalf("Cache disk size should be greater than or equal to 0, now - %d\n", conf.CacheDiskSize)
+	}
+
+	if conf.CacheTTL < 0 {
+		log.Fatalf("Cache TTL should be greater than or equal to 0, now - %d\n", conf.CacheTTL)
+	}
+
+	if conf.SubresourceURLTTL < 0 {
+		log.Fatalf("Subresource URL TTL should be greater than or equal to 0, now - %d\n", conf.SubresourceURLTTL)
+	}
+
+	if conf.OfficeConverterTimeout <= 0 {
+		log.Fatalf("Office converter timeout should be greater than 0, now - %d\n", conf.OfficeConverterTimeout)
+	}
+
+	if conf.PDFConcurrency <= 0 {
+		log.Fatalf("PDF concurrency should be greater than 0, now - %d\n", conf.PDFConcurrency)
+	}
+
+	if conf.PDFRenderTimeout <= 0 {
+		log.Fatalf("PDF render timeout should be greater than 0, now - %d\n", conf.PDFRenderTimeout)
+	}
+
+	if conf.PDFPrerenderPages <= 0 {
+		log.Fatalf("PDF prerender pages should be greater than 0, now - %d\n", conf.PDFPrerenderPages)
+	}
+
+	if conf.PDFPrerenderConcurrency < 0 {
+		log.Fatalf("PDF prerender concurrency should be greater than or equal to 0, now - %d\n", conf.PDFPrerenderConcurrency)
+	}
+
 	if conf.GZipCompression < 0 {
 		log.Fatalf("GZip compression should be greater than or quual to 0, now - %d\n", conf.GZipCompression)
 	} else if conf.GZipCompression > 9 {
 		log.Fatalf("GZip compression can't be greater than 9, now - %d\n", conf.GZipCompression)
 	}
 
+	initBlockedNetworks()
 	initDownloading()
+}
+
+// initServices sets up what serving requests needs beyond the configuration, like the cache,
+// which may walk and clean up its directory, and the PDF renderers. It's left out of init so CLI
+// commands don't do any of it.
+func initServices() {
 	initCache()
+	initPDFRenderers()
+	initPDFPrerendering()
 }
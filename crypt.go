@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var (
+	errInvalidSignature = errors.New("Invalid signature")
+	errExpiredSignature = errors.New("Signature has expired")
+)
+
+func signatureFor(key []byte, salt []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// validateSignature checks the given URL-safe base64 signature of message against
+// every configured key/salt pair, so keys can be rotated without downtime.
+func validateSignature(signature string, message string) error {
+	messageMAC, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	for i := range conf.Keys {
+		if hmac.Equal(messageMAC, signatureFor(conf.Keys[i], conf.Salts[i], message)) {
+			return nil
+		}
+	}
+
+	return errInvalidSignature
+}
+
+// signMessage signs message with the first configured key/salt pair.
+func signMessage(message string) string {
+	return base64.RawURLEncoding.EncodeToString(signatureFor(conf.Keys[0], conf.Salts[0], message))
+}
+
+// legacySignatureMessage is the message covered by the signature of a raw or extract URL with
+// the given path, minus the signature, and query. The optional expiry follows the path, and then
+// every other query parameter, form-encoded with the keys sorted, so none of them can be changed
+// or added without invalidating the signature.
+func legacySignatureMessage(path string, query url.Values) string {
+	message := path
+	if exp := query.Get("exp"); len(exp) > 0 {
+		message += "\n" + exp
+	}
+
+	params := make(url.Values, len(query))
+	for key, values := range query {
+		if key != "exp" {
+			params[key] = values
+		}
+	}
+	if len(params) > 0 {
+		message += "\n" + params.Encode()
+	}
+	return message
+}
+
+// thumbnailSignatureMessage is the message covered by a thumbnail URL signature. Options added
+// after the original ones are only included when set, so existing signatures stay valid.
+func thumbnailSignatureMessage(opts thumbnailOptions) string {
+	message := fmt.Sprintf("thumbnail\n%s\n%d\n%d\n%d", opts.SourceURL, opts.Width, opts.Height, opts.Expires)
+	if opts.MaxDimension > 0 {
+		message += fmt.Sprintf("\nmax=%d", opts.MaxDimension)
+	}
+	if len(opts.Format) > 0 {
+		message += fmt.Sprintf("\nformat=%s", opts.Format)
+	}
+	return message
+}
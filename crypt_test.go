@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withTestKeys(t *testing.T, keys []string, salts []string) func() {
+	oldConf := conf
+
+	conf.Keys = make([][]byte, len(keys))
+	conf.Salts = make([][]byte, len(salts))
+	conf.AllowInsecure = false
+
+	for i := range keys {
+		var err error
+		if conf.Keys[i], err = hex.DecodeString(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+		if conf.Salts[i], err = hex.DecodeString(salts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() { conf = oldConf }
+}
+
+const (
+	testKey  = "943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881"
+	testSalt = "520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5"
+	testPath = "/raw/0/0/0/0/aHR0cHM6Ly9hc3NldC1idW5kbGVzLXByb2QucmV0aWN1bHVtLmlvL3Jvb21zL2F0cml1bS9BdHJpdW1NZXNoZXMtNWY4ZmIwNmQ5Mi5nbHRm"
+	testSig  = "SPE-IRjvRQvGaoCNZ8b8vKRguQd0QRWzpXJGmDYhGk4"
+)
+
+func legacyRequest(t *testing.T, path string) *http.Request {
+	r, err := http.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func Test_legacy_signature_valid(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	if err := checkLegacySignature(legacyRequest(t, "/"+testSig+testPath)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_legacy_signature_rotated_key(t *testing.T) {
+	defer withTestKeys(t, []string{"00ff", testKey}, []string{"ff00", testSalt})()
+
+	if err := checkLegacySignature(legacyRequest(t, "/"+testSig+testPath)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_legacy_signature_tampered(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	if err := checkLegacySignature(legacyRequest(t, "/"+testSig+"/extract/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbQ")); err == nil {
+		t.Fatal("Expected tampered path to be rejected.")
+	}
+	if err := checkLegacySignature(legacyRequest(t, "/0"+testPath)); err == nil {
+		t.Fatal("Expected unsigned path to be rejected.")
+	}
+}
+
+func Test_legacy_signature_insecure(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+	conf.AllowInsecure = true
+
+	if err := checkLegacySignature(legacyRequest(t, "/0"+testPath)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func thumbnailRequestOptions(t *testing.T, u *url.URL) thumbnailOptions {
+	opts, err := parseThumbnailOptions(legacyRequest(t, u.RequestURI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func Test_thumbnail_signature_valid(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	serverURL, _ := url.Parse("http://localhost:8080")
+	u, err := generateThumbnailURL(serverURL, thumbnailOptions{SourceURL: "https://example.com/image.png", Width: 300, Height: 200}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_thumbnail_signature_tampered(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	serverURL, _ := url.Parse("http://localhost:8080")
+	u, err := generateThumbnailURL(serverURL, thumbnailOptions{SourceURL: "https://example.com/image.png", Width: 300, Height: 200}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+	query.Set("w", "400")
+	u.RawQuery = query.Encode()
+
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != errInvalidSignature {
+		t.Fatalf("Expected invalid signature, got %v", err)
+	}
+}
+
+func Test_thumbnail_signature_max_and_format(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	serverURL, _ := url.Parse("http://localhost:8080")
+	u, err := generateThumbnailURL(serverURL, thumbnailOptions{SourceURL: "https://example.com/image.png", MaxDimension: 1024, Format: "image/webp"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := thumbnailRequestOptions(t, u)
+	if opts.MaxDimension != 1024 || opts.Format != "image/webp" {
+		t.Fatalf("Unexpected options: %+v", opts)
+	}
+	if err := checkThumbnailSignature(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	query := u.Query()
+	query.Set("format", "png")
+	u.RawQuery = query.Encode()
+
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != errInvalidSignature {
+		t.Fatalf("Expected invalid signature, got %v", err)
+	}
+}
+
+func Test_thumbnail_signature_expired(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	serverURL, _ := url.Parse("http://localhost:8080")
+	u, err := generateThumbnailURL(serverURL, thumbnailOptions{SourceURL: "https://example.com/image.png", Width: 300, Height: 200}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != errExpiredSignature {
+		t.Fatalf("Expected expired signature, got %v", err)
+	}
+}
+
+func Test_thumbnail_signature_optional(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	u, _ := url.Parse("/thumbnail/" + base64.RawURLEncoding.EncodeToString([]byte("https://example.com/image.png")) + "?w=300&h=200")
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != nil {
+		t.Fatalf("Expected an unsigned thumbnail to be allowed, got %v", err)
+	}
+
+	conf.RequireThumbnailSignatures = true
+	if err := checkThumbnailSignature(thumbnailRequestOptions(t, u)); err != errInvalidSignature {
+		t.Fatalf("Expected an unsigned thumbnail to be rejected when signatures are required, got %v", err)
+	}
+}
+
+func Test_subresource_URL_signed(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	targetURL, _ := url.Parse("https://asset-bundles-prod.reticulum.io/rooms/atrium/AtriumMeshes-5f8fb06d92.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	farsparkURL, err := generateFarsparkURL(targetURL, serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if farsparkURL.Path != "/"+testSig+testPath {
+		t.Fatalf("Unexpected URL: %s", farsparkURL)
+	}
+
+	if err := checkLegacySignature(legacyRequest(t, farsparkURL.RequestURI())); err != nil {
+		t.Fatalf("Expected generated URL to be valid, got %v", err)
+	}
+}
+
+func Test_legacy_signature_covers_query(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+
+	path := "/extract/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9kb2MucGRm"
+	query := url.Values{"format": {"jpeg"}, "q": {"50"}, "w": {"512"}}
+	signed := "/" + signMessage(legacySignatureMessage(path, query)) + path
+
+	// Parameters may come in any order
+	if err := checkLegacySignature(legacyRequest(t, signed+"?w=512&q=50&format=jpeg")); err != nil {
+		t.Fatalf("Expected a signed query to be valid, got %v", err)
+	}
+
+	for _, rawQuery := range []string{"", "format=jpeg&q=50", "format=jpeg&q=50&w=4096", "format=jpeg&q=50&w=512&dpi=600"} {
+		if err := checkLegacySignature(legacyRequest(t, signed+"?"+rawQuery)); err != errInvalidSignature {
+			t.Fatalf("Expected %q to invalidate the signature, got %v", rawQuery, err)
+		}
+	}
+}
+
+func Test_subresource_URL_expiry(t *testing.T) {
+	defer withTestKeys(t, []string{testKey}, []string{testSalt})()
+	conf.SubresourceURLTTL = 60
+
+	targetURL, _ := url.Parse("https://example.com/texture.png")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	farsparkURL, err := generateFarsparkURL(targetURL, serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(farsparkURL.Query().Get("exp")) == 0 {
+		t.Fatalf("Expected URL to expire: %s", farsparkURL)
+	}
+
+	if err := checkLegacySignature(legacyRequest(t, farsparkURL.RequestURI())); err != nil {
+		t.Fatalf("Expected generated URL to be valid, got %v", err)
+	}
+
+	// Moving the expiry invalidates the signature
+	tampered := *farsparkURL
+	tampered.RawQuery = "exp=" + strconv.FormatInt(time.Now().Unix()+3600, 10)
+	if err := checkLegacySignature(legacyRequest(t, tampered.RequestURI())); err != errInvalidSignature {
+		t.Fatalf("Expected invalid signature, got %v", err)
+	}
+
+	expires := time.Now().Unix() - 1
+	path := strings.SplitN(farsparkURL.Path, "/", 3)[2]
+	query := url.Values{"exp": {strconv.FormatInt(expires, 10)}}
+	expired := "/" + signMessage(legacySignatureMessage("/"+path, query)) + "/" + path + "?" + query.Encode()
+	if err := checkLegacySignature(legacyRequest(t, expired)); err != errExpiredSignature {
+		t.Fatalf("Expected expired signature, got %v", err)
+	}
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	_ "golang.org/x/image/webp"
@@ -16,6 +16,9 @@ import (
 
 var downloadClient *http.Client
 
+// Most of an error response's body quoted in download errors.
+const maxErrorBodySize = 256
+
 type mimeType = string
 
 type netReader struct {
@@ -42,75 +45,221 @@ func (r *netReader) GrowBuf(s int) {
 }
 
 func initDownloading() {
-	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
+	downloadClient = &http.Client{
+		Timeout:       time.Duration(conf.DownloadTimeout) * time.Second,
+		Transport:     newDownloadTransport(http.ProxyFromEnvironment),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+func newDownloadTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(conf.DownloadTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:               newGuardedProxy(proxy),
+		DialContext:         newGuardedDialContext(dialer),
 		DisableKeepAlives:   true,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 	}
-	downloadClient = &http.Client{
-		Timeout:   time.Duration(conf.DownloadTimeout) * time.Second,
-		Transport: transport,
-	}
 }
 
-func readAndCheckMediaResponse(res *http.Response) ([]byte, error) {
-	nr := newNetReader(res.Body)
+func newSourceTooBigError(size int64, maxSize int) farsparkError {
+	return newError(413, fmt.Sprintf("Source file is too big: %d bytes; limit is %d bytes", size, maxSize), "Source file is too big")
+}
+
+// readAndCheckMediaResponse reads the response body, failing as soon as it's known to be larger
+// than maxSize bytes. A maxSize of 0 means no limit.
+func readAndCheckMediaResponse(res *http.Response, maxSize int) ([]byte, error) {
+	if maxSize > 0 && res.ContentLength > int64(maxSize) {
+		return nil, newSourceTooBigError(res.ContentLength, maxSize)
+	}
+
+	var body io.Reader = res.Body
+	if maxSize > 0 {
+		// Read one byte past the limit so we can tell a body of exactly maxSize from a bigger one
+		body = io.LimitReader(res.Body, int64(maxSize)+1)
+	}
+
+	nr := newNetReader(body)
 
 	if res.ContentLength > 0 {
 		nr.GrowBuf(int(res.ContentLength))
 	}
 
-	return nr.ReadAll()
+	data, err := nr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && len(data) > maxSize {
+		return nil, newSourceTooBigError(int64(len(data)), maxSize)
+	}
+
+	return data, nil
 }
 
-func shouldCacheMimeType(t mimeType) bool {
-	// For now, just cache PDF files locally since we re-fetch new pages over and over,
-	// and they tend to be big files
-	if t == "application/pdf" {
-		return true
+// maxSizeReader fails with a 413 error once more than MaxSize bytes have been read from it.
+type maxSizeReader struct {
+	r       io.Reader
+	read    int64
+	maxSize int
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.read > int64(r.maxSize) {
+		return n, newSourceTooBigError(r.read, r.maxSize)
 	}
+	return n, err
+}
 
-	return false
+// limitMediaResponse returns the response body as a reader which fails once it's read past
+// maxSize bytes, for bodies which are streamed rather than read with readAndCheckMediaResponse.
+func limitMediaResponse(res *http.Response, maxSize int) (io.Reader, error) {
+	if maxSize <= 0 {
+		return res.Body, nil
+	}
+
+	if res.ContentLength > int64(maxSize) {
+		return nil, newSourceTooBigError(res.ContentLength, maxSize)
+	}
+
+	return &maxSizeReader{r: res.Body, maxSize: maxSize}, nil
 }
 
-func downloadMedia(url string) ([]byte, mimeType, error) {
-	sha256 := sha256.New()
-	sha256.Write([]byte(url))
-	sha256.Write([]byte("src"))
-	srcCacheKey := base64.URLEncoding.EncodeToString(sha256.Sum(nil))
+// detectMediaType sniffs the MIME type of data like http.DetectContentType, and additionally
+// recognizes QuickTime movies and office documents, which it doesn't.
+func detectMediaType(data []byte) mimeType {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" && string(data[8:12]) == "qt  " {
+		return "video/quicktime"
+	}
 
-	if farsparkCache != nil && farsparkCache.Has(srcCacheKey) {
-		bytes, err := farsparkCache.Read(srcCacheKey)
-		if err != nil {
-			return nil, "", err
-		}
+	detected := http.DetectContentType(data)
 
-		return bytes, http.DetectContentType(bytes), err
-	} else {
-		res, err := downloadClient.Get(url)
-		if err != nil {
-			return nil, "", err
+	if detected == "application/zip" {
+		if officeType := detectOfficeType(data); len(officeType) > 0 {
+			return officeType
 		}
-		defer res.Body.Close()
+	}
 
-		if res.StatusCode != 200 {
-			body, _ := ioutil.ReadAll(res.Body)
-			return nil, "", fmt.Errorf("Can't download media; Status: %d; %s", res.StatusCode, string(body))
-		}
+	return detected
+}
 
-		bytes, err := readAndCheckMediaResponse(res)
-		if err != nil {
-			return nil, "", err
-		}
+func shouldCacheMimeType(t mimeType) bool {
+	// For now, just cache PDF files and videos locally since we re-fetch new pages and frames over
+	// and over, and they tend to be big files
+	return t == "application/pdf" || videoMimeTypes[t]
+}
+
+type downloadResult struct {
+	data     []byte
+	mimeType mimeType
+	err      error
+}
+
+// downloadMedia returns the media at url, like fetchMedia. Concurrent downloads of the same media
+// share one fetch, so the data returned mustn't be modified.
+func downloadMedia(url string, maxSize int) ([]byte, mimeType, error) {
+	key := fmt.Sprintf("%s;%d", getSourceCacheKey(url), maxSize)
+	result, _ := downloadFlights.Do(key, func() interface{} {
+		data, mimeType, err := fetchMedia(url, maxSize)
+		return downloadResult{data, mimeType, err}
+	})
+	download := result.(downloadResult)
+	return download.data, download.mimeType, download.err
+}
 
-		mimeType := http.DetectContentType(bytes)
-		if err == nil && shouldCacheMimeType(mimeType) && farsparkCache != nil {
-			farsparkCache.Write(srcCacheKey, bytes)
+// fetchMedia returns the media at url, from the cache while it's fresh, or once the origin
+// confirms it hasn't changed.
+func fetchMedia(url string, maxSize int) ([]byte, mimeType, error) {
+	info, hasInfo := readSourceInfo(url)
+
+	var cached []byte
+	if hasInfo && info.BodyCached {
+		if data, err := farsparkCache.Get(getSourceCacheKey(url)); err == nil {
+			if info.fresh() {
+				return data, detectMediaType(data), nil
+			}
+			cached = data
 		}
+	}
 
-		return bytes, mimeType, err
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if cached != nil {
+		setConditionalHeaders(req, info)
 	}
+
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, "", downloadError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		info.update(res.Header)
+		writeSourceInfo(url, info)
+		return cached, detectMediaType(cached), nil
+	}
+
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		return nil, "", fmt.Errorf("Can't download media; Status: %d; %s", res.StatusCode, string(body))
+	}
+
+	bytes, err := readAndCheckMediaResponse(res, maxSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mimeType := detectMediaType(bytes)
+	if farsparkCache != nil {
+		storeSource(url, bytes, mimeType, res.Header)
+	}
+
+	return bytes, mimeType, nil
+}
+
+// downloadMediaPrefix downloads at most the first prefixSize bytes of the media at url, e.g. to
+// read an image's header, and returns them with the size of the whole media, or -1 if the origin
+// doesn't say.
+func downloadMediaPrefix(url string, prefixSize int) ([]byte, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", prefixSize-1))
+
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, -1, downloadError(err)
+	}
+	defer res.Body.Close()
+
+	size := int64(-1)
+	switch res.StatusCode {
+	case http.StatusOK:
+		size = res.ContentLength
+	case http.StatusPartialContent:
+		var first, last int64
+		fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size)
+	default:
+		return nil, -1, fmt.Errorf("Can't download media; Status: %d", res.StatusCode)
+	}
+
+	// Origins which ignore Range send the whole thing, so stop reading once we have enough
+	prefix, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(prefixSize)))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return prefix, size, nil
 }
 
 func streamMedia(url string, incomingRequest *http.Request) (*http.Response, error) {
@@ -130,7 +279,7 @@ func streamMedia(url string, incomingRequest *http.Request) (*http.Response, err
 
 	res, err := downloadClient.Do(outgoingRequest)
 	if err != nil {
-		return nil, err
+		return nil, downloadError(err)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allowLoopback lets downloads reach httptest servers, which listen on loopback addresses.
+func allowLoopback() func() {
+	oldConf := conf
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	conf.AllowedNetworks = []*net.IPNet{loopback}
+	return func() { conf = oldConf }
+}
+
+func newSizedServer(body string, chunked bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if chunked {
+			rw.(http.Flusher).Flush()
+		}
+		rw.Write([]byte(body))
+	}))
+}
+
+func Test_download_max_size(t *testing.T) {
+	defer allowLoopback()()
+
+	for _, chunked := range []bool{false, true} {
+		server := newSizedServer(strings.Repeat("x", 100), chunked)
+
+		if _, _, err := downloadMedia(server.URL, 100); err != nil {
+			t.Errorf("Expected body at the limit to be accepted, got %v", err)
+		}
+
+		_, _, err := downloadMedia(server.URL, 99)
+		if ferr, ok := err.(farsparkError); !ok || ferr.StatusCode != 413 {
+			t.Errorf("Expected 413 error (chunked=%v), got %v", chunked, err)
+		}
+
+		server.Close()
+	}
+}
+
+func Test_download_error_body(t *testing.T) {
+	defer allowLoopback()()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(500)
+		rw.Write([]byte(strings.Repeat("x", 10000)))
+	}))
+	defer server.Close()
+
+	_, _, err := downloadMedia(server.URL, 100)
+	if err == nil || !strings.Contains(err.Error(), "Status: 500") || len(err.Error()) > 100+maxErrorBodySize {
+		t.Fatalf("Expected an error quoting only the start of the body, got %d bytes", len(fmt.Sprint(err)))
+	}
+}
+
+func Test_download_prefix(t *testing.T) {
+	defer allowLoopback()()
+
+	body := strings.Repeat("x", 100)
+	ranged := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.ServeContent(rw, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer ranged.Close()
+	unranged := newSizedServer(body, false)
+	defer unranged.Close()
+
+	for _, server := range []*httptest.Server{ranged, unranged} {
+		prefix, size, err := downloadMediaPrefix(server.URL, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(prefix) != body[:10] || size != 100 {
+			t.Errorf("Expected 10 bytes of 100, got %d of %d", len(prefix), size)
+		}
+	}
+}
+
+func Test_detect_quicktime(t *testing.T) {
+	mov := []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  ")
+	if mimeType := detectMediaType(mov); mimeType != "video/quicktime" {
+		t.Fatalf("Expected video/quicktime, got %s", mimeType)
+	}
+}
+
+func Test_detect_office_documents(t *testing.T) {
+	cases := map[string]mimeType{
+		"ppt/presentation.xml": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"word/document.xml":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"other/file.txt":       "application/zip",
+	}
+
+	for name, expected := range cases {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		archive.Create("[Content_Types].xml")
+		archive.Create(name)
+		archive.Close()
+
+		if mimeType := detectMediaType(buf.Bytes()); mimeType != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, name, mimeType)
+		}
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	w, _ := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	w.Write([]byte("application/vnd.oasis.opendocument.presentation"))
+	archive.Close()
+
+	if mimeType := detectMediaType(buf.Bytes()); mimeType != "application/vnd.oasis.opendocument.presentation" {
+		t.Errorf("Expected ODP, got %s", mimeType)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"runtime"
 	"strings"
@@ -20,13 +21,28 @@ func newError(status int, msg string, pub string) farsparkError {
 	return farsparkError{status, msg, pub}
 }
 
+// wrapError passes farsparkErrors through as is, and wraps any other error with the given
+// status and public message.
+func wrapError(err error, status int, pub string) farsparkError {
+	if ferr, ok := err.(farsparkError); ok {
+		return ferr
+	}
+	return newError(status, err.Error(), pub)
+}
+
 func newUnexpectedError(err error, skip int) farsparkError {
 	msg := fmt.Sprintf("Unexpected error: %s\n%s", err, stacktrace(skip+1))
 	return farsparkError{500, msg, "Internal error"}
 }
 
+var errIndexOutOfRange = errors.New("Requested index is out of range")
+
 var (
-	invalidMethodErr = newError(422, "Invalid request method", "Method doesn't allowed")
+	invalidMethodErr     = newError(422, "Invalid request method", "Method doesn't allowed")
+	invalidSignatureErr  = newError(403, "Invalid signature", "Forbidden")
+	expiredSignatureErr  = newError(403, "Signature has expired", "Forbidden")
+	invalidAdminTokenErr = newError(401, "Invalid admin token", "Unauthorized")
+	sourceNotAllowedErr  = newError(403, "Source is not allowed", "Source is not allowed")
 )
 
 func stacktrace(skip int) string {
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/url"
+)
+
+// Binary glTF container constants, see
+// https://github.com/KhronosGroup/glTF/tree/master/specification/2.0#glb-file-format-specification
+const (
+	glbMagic      = 0x46546C67 // "glTF"
+	glbVersion    = 2
+	glbHeaderSize = 12
+	glbChunkJSON  = 0x4E4F534A // "JSON"
+)
+
+var errInvalidGLB = errors.New("Invalid GLB")
+
+type glbChunk struct {
+	Type uint32
+	Data []byte
+}
+
+func isGLB(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == glbMagic
+}
+
+func readGLBChunks(data []byte) ([]glbChunk, error) {
+	if len(data) < glbHeaderSize || !isGLB(data) {
+		return nil, errInvalidGLB
+	}
+
+	if binary.LittleEndian.Uint32(data[4:]) != glbVersion {
+		return nil, errors.New("Unsupported GLB version")
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[8:]))
+	if length < glbHeaderSize || length > len(data) {
+		return nil, errInvalidGLB
+	}
+
+	chunks := make([]glbChunk, 0, 2)
+	for pos := glbHeaderSize; pos < length; {
+		if pos+8 > length {
+			return nil, errInvalidGLB
+		}
+		chunkLength := int(binary.LittleEndian.Uint32(data[pos:]))
+		chunkType := binary.LittleEndian.Uint32(data[pos+4:])
+		end := pos + 8 + chunkLength
+		if chunkLength < 0 || end > length {
+			return nil, errInvalidGLB
+		}
+		chunks = append(chunks, glbChunk{chunkType, data[pos+8 : end]})
+		pos = end
+	}
+
+	if len(chunks) == 0 || chunks[0].Type != glbChunkJSON {
+		return nil, errInvalidGLB
+	}
+
+	return chunks, nil
+}
+
+// writeGLB packs chunks into a GLB container. The JSON chunk is padded with spaces to keep the
+// chunks that follow it 4-byte aligned, as the spec requires.
+func writeGLB(chunks []glbChunk) []byte {
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		data := chunk.Data
+		if chunk.Type == glbChunkJSON && len(data)%4 != 0 {
+			data = append(append([]byte{}, data...), bytes.Repeat([]byte(" "), 4-len(data)%4)...)
+		}
+		binary.Write(&body, binary.LittleEndian, uint32(len(data)))
+		binary.Write(&body, binary.LittleEndian, chunk.Type)
+		body.Write(data)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(glbMagic))
+	binary.Write(&buf, binary.LittleEndian, uint32(glbVersion))
+	binary.Write(&buf, binary.LittleEndian, uint32(glbHeaderSize+body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// processGLB rewrites the external URIs in the JSON chunk of a binary glTF, leaving the binary
+// chunk, and so any buffer views embedded in it, untouched.
+func processGLB(data []byte, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) ([]byte, error) {
+	chunks, err := readGLBChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var json []byte
+	if conf.GLTFPatchInPlace && !opts.sanitizes() {
+		json, err = patchGLTFBytes(chunks[0].Data, baseURL, serverURL, opts)
+	} else {
+		json, err = processGLTF(chunks[0].Data, baseURL, serverURL, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunks[0].Data = json
+
+	return writeGLB(chunks), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/url"
+	"testing"
+)
+
+const glbChunkBIN = 0x004E4942 // "BIN\x00"
+
+func Test_GLB_rewrite(t *testing.T) {
+	in, out := loadTestData(t, "in3.gltf", "out3.gltf")
+	bin := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	baseURL, err := url.Parse("https://poly.googleapis.com/downloads/2PDe5PSncTC/bM1VRy9M_TP/Wolf_01.gltf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, err := url.Parse("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := processGLB(writeGLB([]glbChunk{{glbChunkJSON, in}, {glbChunkBIN, bin}}), baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int(binary.LittleEndian.Uint32(result[8:])) != len(result) {
+		t.Fatal("GLB length doesn't match its contents")
+	}
+
+	chunks, err := readGLBChunks(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0].Data)%4 != 0 {
+		t.Fatal("JSON chunk isn't 4-byte aligned")
+	}
+	if !bytes.Equal(bytes.TrimRight(chunks[0].Data, " "), out) {
+		t.Fatal("Unexpected JSON chunk.")
+	}
+	if chunks[1].Type != glbChunkBIN || !bytes.Equal(chunks[1].Data, bin) {
+		t.Fatal("Binary chunk was modified.")
+	}
+}
+
+func Test_GLB_embedded_buffer(t *testing.T) {
+	json := []byte(`{"asset":{"version":"2.0"},"buffers":[{"byteLength":8}],"images":[{"bufferView":0,"mimeType":"image/png"},{"uri":"tex.png"}]}`)
+
+	baseURL, _ := url.Parse("https://example.com/models/model.glb")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	result, err := processGLB(writeGLB([]glbChunk{{glbChunkJSON, json}, {glbChunkBIN, make([]byte, 8)}}), baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := readGLBChunks(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"asset":{"version":"2.0"},"buffers":[{"byteLength":8}],"images":[{"bufferView":0,"mimeType":"image/png"},{"uri":"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9tb2RlbHMvdGV4LnBuZw"}]}`
+	if string(bytes.TrimRight(chunks[0].Data, " ")) != expected {
+		t.Fatalf("Unexpected JSON chunk: %s", chunks[0].Data)
+	}
+}
+
+func Test_GLB_invalid(t *testing.T) {
+	if _, err := readGLBChunks([]byte("glTF\x02\x00\x00\x00\xff\x00\x00\x00")); err == nil {
+		t.Fatal("Expected truncated GLB to be rejected")
+	}
+	if _, err := readGLBChunks([]byte("not a glb at all")); err == nil {
+		t.Fatal("Expected non-GLB to be rejected")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// gltfURIPaths lists where subresource URIs are found in a glTF document. "*" matches every
+// element of an array or value of an object.
+//
+// Images referenced by texture extensions such as KHR_texture_basisu, EXT_texture_webp and
+// MSFT_texture_dds, and by MSFT_lod levels, are indices into images, so their URIs are covered by
+// images.*.uri.
+var gltfURIPaths = [][]string{
+	{"images", "*", "uri"},
+	{"buffers", "*", "uri"},
+	{"extensions", "KHR_audio", "audio", "*", "uri"},
+	{"extensions", "MSFT_audio_emitter", "clips", "*", "uri"},
+	{"nodes", "*", "extensions", "MOZ_hubs_components", "*", "src"},
+	{"scenes", "*", "extensions", "MOZ_hubs_components", "*", "src"},
+}
+
+// walkGLTFPath calls fn with every string found at path in v, replacing it with the result.
+// Values which are missing or of another type are left alone.
+func walkGLTFPath(v interface{}, path []string, fn func(string) (string, error)) (interface{}, error) {
+	if len(path) == 0 {
+		if s, ok := v.(string); ok {
+			return fn(s)
+		}
+		return v, nil
+	}
+
+	switch node := v.(type) {
+	case []interface{}:
+		if path[0] != "*" {
+			return v, nil
+		}
+		for i := range node {
+			child, err := walkGLTFPath(node[i], path[1:], fn)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = child
+		}
+	case map[string]interface{}:
+		for key := range node {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			child, err := walkGLTFPath(node[key], path[1:], fn)
+			if err != nil {
+				return nil, err
+			}
+			node[key] = child
+		}
+	}
+
+	return v, nil
+}
+
+// isEmbeddedURI reports whether uri carries its content itself rather than referencing it.
+func isEmbeddedURI(uri string) bool {
+	return len(uri) == 0 || strings.HasPrefix(strings.ToLower(uri), "data:")
+}
+
+// Extensions of the texture images the thumbnail method can scale down and transcode.
+var downscalableTextureExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".webp": true,
+}
+
+// rewriteTextureReference returns a thumbnail URL which scales down and transcodes the texture
+// image ref, relative to baseURL, according to opts. Images the thumbnail method can't decode,
+// such as KTX2 textures, are proxied as is.
+func rewriteTextureReference(ref string, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) (string, error) {
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	targetURL := baseURL.ResolveReference(refURL)
+
+	if !downscalableTextureExtensions[strings.ToLower(path.Ext(targetURL.Path))] {
+		return rewriteReference(ref, baseURL, serverURL)
+	}
+
+	if !isAllowedSource(targetURL) {
+		return "", sourceNotAllowedErr
+	}
+
+	maxDimension := opts.TextureMaxDimension
+	if maxDimension == 0 {
+		maxDimension = conf.MaxDimension
+	}
+
+	var expires time.Time
+	if conf.SubresourceURLTTL > 0 {
+		expires = time.Now().Add(time.Duration(conf.SubresourceURLTTL) * time.Second)
+	}
+
+	thumbnailURL, err := generateThumbnailURL(serverURL, thumbnailOptions{
+		SourceURL:    targetURL.String(),
+		MaxDimension: maxDimension,
+		Format:       opts.TextureFormat,
+	}, expires)
+	if err != nil {
+		return "", err
+	}
+	return thumbnailURL.String(), nil
+}
+
+// gltfURIRewriter returns a function which rewrites the subresource URI found at pattern, one of
+// gltfURIPaths, in a glTF at baseURL.
+func gltfURIRewriter(baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) func(pattern []string, uri string) (string, error) {
+	return func(pattern []string, uri string) (string, error) {
+		if isEmbeddedURI(uri) {
+			return uri, nil
+		}
+		if pattern[0] == "images" && opts.rewritesTextures() {
+			return rewriteTextureReference(uri, baseURL, serverURL, opts)
+		}
+		return rewriteReference(uri, baseURL, serverURL)
+	}
+}
+
+func processGLTF(data []byte, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) ([]byte, error) {
+	var model interface{}
+	err := json.Unmarshal(data, &model)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj, ok := model.(map[string]interface{}); ok {
+		sanitizeGLTF(obj, opts)
+	}
+
+	rewriteURI := gltfURIRewriter(baseURL, serverURL, opts)
+
+	for _, pattern := range gltfURIPaths {
+		pattern := pattern
+		rewritePatternURI := func(uri string) (string, error) {
+			return rewriteURI(pattern, uri)
+		}
+		if model, err = walkGLTFPath(model, pattern, rewritePatternURI); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testGLTFRewrite(t *testing.T, inFile string, outFile string) {
+	in, out := loadTestData(t, inFile, outFile)
+	baseURL, err := url.Parse("https://assets.example.com/scenes/room.gltf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, err := url.Parse("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := processGLTF(in, baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, result) {
+		t.Fatalf("Unexpected output: %s", result)
+	}
+}
+
+func Test_GLTF_embedded_resources(t *testing.T) {
+	testGLTFRewrite(t, "in4.gltf", "out4.gltf")
+}
+
+func Test_GLTF_texture_extensions(t *testing.T) {
+	testGLTFRewrite(t, "in5.gltf", "out5.gltf")
+}
+
+func Test_GLTF_hubs_components(t *testing.T) {
+	testGLTFRewrite(t, "in6.gltf", "out6.gltf")
+}
+
+func Test_GLTF_audio_extensions(t *testing.T) {
+	testGLTFRewrite(t, "in7.gltf", "out7.gltf")
+}
+
+func Test_GLTF_patch_in_place(t *testing.T) {
+	for _, files := range [][2]string{{"in4.gltf", "out4.gltf"}, {"in5.gltf", "out5.gltf"}, {"in6.gltf", "out6.gltf"}, {"in7.gltf", "out7.gltf"}} {
+		in, out := loadTestData(t, files[0], files[1])
+		baseURL, _ := url.Parse("https://assets.example.com/scenes/room.gltf")
+		serverURL, _ := url.Parse("http://localhost:8080")
+
+		result, err := patchGLTFBytes(in, baseURL, serverURL, rewriteOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Patching and re-encoding agree on the content...
+		var model interface{}
+		if err := json.Unmarshal(result, &model); err != nil {
+			t.Fatal(err)
+		}
+		if reencoded, _ := json.Marshal(model); !bytes.Equal(reencoded, out) {
+			t.Fatalf("Unexpected output for %s: %s", files[0], result)
+		}
+
+		// ...but patching leaves the formatting alone
+		if bytes.Count(result, []byte("\n")) != bytes.Count(in, []byte("\n")) {
+			t.Fatalf("Formatting of %s wasn't preserved: %s", files[0], result)
+		}
+	}
+}
+
+func Test_GLTF_patch_preserves_bytes(t *testing.T) {
+	in := `{ "buffers" : [ { "uri" : "a.bin", "byteLength" : 18446744073709551615 } ], "asset": {"version": "2.0"},` +
+		` "images": [{"uri": "data:image/png;base64,AA=="}, {"name": "uri \"quoted\"", "uri": "b.png"}] }`
+	expected := `{ "buffers" : [ { "uri" : "http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9hLmJpbg", "byteLength" : 18446744073709551615 } ], "asset": {"version": "2.0"},` +
+		` "images": [{"uri": "data:image/png;base64,AA=="}, {"name": "uri \"quoted\"", "uri": "http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9iLnBuZw"}] }`
+
+	baseURL, _ := url.Parse("https://example.com/model.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	result, err := patchGLTFBytes([]byte(in), baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != expected {
+		t.Fatalf("Unexpected output: %s", result)
+	}
+}
+
+func Test_GLTF_patch_invalid(t *testing.T) {
+	baseURL, _ := url.Parse("https://example.com/model.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	for _, in := range []string{`{"images": [{"uri": "a.png"}`, `{"images": [{"uri": "a.png}]}`, `{"images": ]}`} {
+		if _, err := patchGLTFBytes([]byte(in), baseURL, serverURL, rewriteOptions{}); err == nil {
+			t.Fatalf("Expected %s to be rejected", in)
+		}
+	}
+}
+
+func Test_GLTF_patch_in_place_aborts_invalid(t *testing.T) {
+	defer allowLoopback()()
+	conf.GLTFPatchInPlace = true
+	conf.ServerURL, _ = url.Parse("http://localhost:8080")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "model/gltf+json")
+		rw.Write([]byte(`{"images": [{"uri": "a.png"}`))
+	}))
+	defer origin.Close()
+
+	// The status has been sent by the time patching fails, so the response has to be aborted
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Fatalf("Expected the response to be aborted, got %v", r)
+		}
+	}()
+	path := "/0/raw/0/0/0/0/" + base64.RawURLEncoding.EncodeToString([]byte(origin.URL+"/model.gltf"))
+	newHTTPHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+func Test_GLTF_texture_downscaling(t *testing.T) {
+	in, _ := loadTestData(t, "in5.gltf", "out5.gltf")
+	baseURL, _ := url.Parse("https://assets.example.com/scenes/room.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	opts := rewriteOptions{TextureMaxDimension: 1024, TextureFormat: "image/webp"}
+	for _, rewrite := range []func([]byte, *url.URL, *url.URL, rewriteOptions) ([]byte, error){processGLTF, patchGLTFBytes} {
+		result, err := rewrite(in, baseURL, serverURL, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var model struct {
+			Images []struct {
+				URI string `json:"uri"`
+			} `json:"images"`
+		}
+		if err := json.Unmarshal(result, &model); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			"http://localhost:8080/thumbnail/aHR0cHM6Ly9hc3NldHMuZXhhbXBsZS5jb20vc2NlbmVzL3RleHR1cmVzL2RpZmZ1c2UucG5n?format=webp&max=1024",
+			// KTX2 textures can't be scaled down, so they're proxied as is
+			"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9hc3NldHMuZXhhbXBsZS5jb20vc2NlbmVzL3RleHR1cmVzL2RpZmZ1c2Uua3R4Mg",
+			"http://localhost:8080/thumbnail/aHR0cHM6Ly9hc3NldHMuZXhhbXBsZS5jb20vc2NlbmVzL3RleHR1cmVzL2RpZmZ1c2Uud2VicA?format=webp&max=1024",
+		}
+		for i, image := range model.Images {
+			if image.URI != expected[i] {
+				t.Fatalf("Unexpected URI for image %d: %s", i, image.URI)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+)
+
+var errInvalidJSON = errors.New("Invalid JSON")
+
+// jsonContainer is an object or array the patcher is inside of, along with where in it it is.
+type jsonContainer struct {
+	IsArray   bool
+	Key       string
+	ExpectKey bool
+}
+
+// gltfPatcher copies a glTF document from a reader to a writer, replacing only the string values
+// at gltfURIPaths, so everything else comes out byte for byte as it went in. It only keeps the
+// path to the current value in memory rather than the whole document.
+type gltfPatcher struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	stack   []jsonContainer
+	rewrite func(pattern []string, uri string) (string, error)
+}
+
+// matchURIPath returns the one of gltfURIPaths the current value is at, if any.
+func (p *gltfPatcher) matchURIPath() ([]string, bool) {
+	for _, pattern := range gltfURIPaths {
+		if len(pattern) != len(p.stack) {
+			continue
+		}
+
+		matches := true
+		for i, c := range p.stack {
+			if c.IsArray && pattern[i] != "*" || !c.IsArray && pattern[i] != "*" && pattern[i] != c.Key {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return pattern, true
+		}
+	}
+
+	return nil, false
+}
+
+// readString reads the rest of a JSON string after its opening quote, returning it raw, quotes
+// and escapes included.
+func (p *gltfPatcher) readString() ([]byte, error) {
+	raw := []byte{'"'}
+	escaped := false
+
+	for {
+		b, err := p.r.ReadByte()
+		if err == io.EOF {
+			return nil, errInvalidJSON
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		raw = append(raw, b)
+
+		if escaped {
+			escaped = false
+		} else if b == '\\' {
+			escaped = true
+		} else if b == '"' {
+			return raw, nil
+		}
+	}
+}
+
+func (p *gltfPatcher) writeString(raw []byte) error {
+	top := &p.stack[len(p.stack)-1]
+
+	if !top.IsArray && top.ExpectKey {
+		if err := json.Unmarshal(raw, &top.Key); err != nil {
+			return err
+		}
+		_, err := p.w.Write(raw)
+		return err
+	}
+
+	pattern, ok := p.matchURIPath()
+	if !ok {
+		_, err := p.w.Write(raw)
+		return err
+	}
+
+	var uri string
+	if err := json.Unmarshal(raw, &uri); err != nil {
+		return err
+	}
+
+	newURI, err := p.rewrite(pattern, uri)
+	if err != nil {
+		return err
+	}
+
+	if newURI != uri {
+		if raw, err = json.Marshal(newURI); err != nil {
+			return err
+		}
+	}
+
+	_, err = p.w.Write(raw)
+	return err
+}
+
+func (p *gltfPatcher) run() error {
+	for {
+		b, err := p.r.ReadByte()
+		if err == io.EOF {
+			if len(p.stack) > 0 {
+				return errInvalidJSON
+			}
+			return p.w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		switch b {
+		case '{', '[':
+			p.stack = append(p.stack, jsonContainer{IsArray: b == '[', ExpectKey: b == '{'})
+		case '}', ']':
+			if len(p.stack) == 0 || p.stack[len(p.stack)-1].IsArray != (b == ']') {
+				return errInvalidJSON
+			}
+			p.stack = p.stack[:len(p.stack)-1]
+		case ':':
+			if len(p.stack) == 0 {
+				return errInvalidJSON
+			}
+			p.stack[len(p.stack)-1].ExpectKey = false
+		case ',':
+			if len(p.stack) == 0 {
+				return errInvalidJSON
+			}
+			top := &p.stack[len(p.stack)-1]
+			top.ExpectKey = !top.IsArray
+		case '"':
+			if len(p.stack) == 0 {
+				return errInvalidJSON
+			}
+			raw, err := p.readString()
+			if err != nil {
+				return err
+			}
+			if err := p.writeString(raw); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Everything else, i.e. whitespace, numbers, booleans and nulls, is copied as is
+		if err := p.w.WriteByte(b); err != nil {
+			return err
+		}
+	}
+}
+
+// patchGLTF streams the glTF document from r to w, rewriting its subresource URIs in place.
+func patchGLTF(r io.Reader, w io.Writer, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) error {
+	p := &gltfPatcher{
+		r:       bufio.NewReader(r),
+		w:       bufio.NewWriter(w),
+		rewrite: gltfURIRewriter(baseURL, serverURL, opts),
+	}
+	return p.run()
+}
+
+// patchGLTFBytes is patchGLTF for documents which are already in memory.
+func patchGLTFBytes(data []byte, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	if err := patchGLTF(bytes.NewReader(data), &buf, baseURL, serverURL, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+// stripUnknownGLTFExtensions removes every extension which isn't in knownGLTFExtensions from a
+// parsed glTF document, and from its extensionsUsed. Documents which require an unknown extension
+// are left alone, since they can't be loaded without the data it holds.
+func stripUnknownGLTFExtensions(model map[string]interface{}) {
+	required, _ := model["extensionsRequired"].([]interface{})
+	for _, name := range required {
+		if s, ok := name.(string); !ok || !knownGLTFExtensions[s] {
+			return
+		}
+	}
+
+	if names, ok := model["extensionsUsed"].([]interface{}); ok {
+		known := []interface{}{}
+		for _, name := range names {
+			if s, ok := name.(string); ok && knownGLTFExtensions[s] {
+				known = append(known, name)
+			}
+		}
+		if len(known) > 0 {
+			model["extensionsUsed"] = known
+		} else {
+			delete(model, "extensionsUsed")
+		}
+	}
+
+	var strip func(v interface{})
+	strip = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if extensions, ok := v["extensions"].(map[string]interface{}); ok {
+				for name := range extensions {
+					if !knownGLTFExtensions[name] {
+						delete(extensions, name)
+					}
+				}
+				if len(extensions) == 0 {
+					delete(v, "extensions")
+				}
+			}
+			for _, child := range v {
+				strip(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				strip(child)
+			}
+		}
+	}
+	strip(model)
+}
+
+// removeGLTFElements removes the elements of the top-level array collection for which remove
+// returns true, and returns a map from the old indices of those which are left to their new ones.
+func removeGLTFElements(model map[string]interface{}, collection string, remove func(element map[string]interface{}) bool) map[int]int {
+	remap := make(map[int]int)
+	elements, ok := model[collection].([]interface{})
+	if !ok {
+		return remap
+	}
+
+	kept := []interface{}{}
+	for i, element := range elements {
+		obj, ok := element.(map[string]interface{})
+		if ok && remove(obj) {
+			continue
+		}
+		remap[i] = len(kept)
+		kept = append(kept, element)
+	}
+
+	model[collection] = kept
+	return remap
+}
+
+// remapGLTFIndex updates the index at key of obj after elements were removed, deleting it and
+// returning false if the element it referred to was removed.
+func remapGLTFIndex(obj map[string]interface{}, key string, remap map[int]int) bool {
+	index, ok := obj[key].(float64)
+	if !ok {
+		return true
+	}
+	newIndex, ok := remap[int(index)]
+	if !ok {
+		delete(obj, key)
+		return false
+	}
+	obj[key] = float64(newIndex)
+	return true
+}
+
+// forEachGLTFElement calls fn with each object in the array at key of obj.
+func forEachGLTFElement(obj map[string]interface{}, key string, fn func(element map[string]interface{})) {
+	elements, _ := obj[key].([]interface{})
+	for _, element := range elements {
+		if element, ok := element.(map[string]interface{}); ok {
+			fn(element)
+		}
+	}
+}
+
+// extensionObject returns the object for the extension name of obj, if it has one.
+func extensionObject(obj map[string]interface{}, name string) (map[string]interface{}, bool) {
+	extensions, _ := obj["extensions"].(map[string]interface{})
+	extension, ok := extensions[name].(map[string]interface{})
+	return extension, ok
+}
+
+func deleteExtension(obj map[string]interface{}, name string) {
+	if extensions, ok := obj["extensions"].(map[string]interface{}); ok {
+		delete(extensions, name)
+		if len(extensions) == 0 {
+			delete(obj, "extensions")
+		}
+	}
+}
+
+// stripOversizedGLTFBuffers removes external buffers larger than maxSize from a parsed glTF
+// document, so clients never download them. Buffer views in them are removed too; accessors which
+// used them are left without a buffer view, so they read as zeros, and images stored in them are
+// removed from the textures which used them.
+func stripOversizedGLTFBuffers(model map[string]interface{}, maxSize int64) {
+	bufferRemap := removeGLTFElements(model, "buffers", func(buffer map[string]interface{}) bool {
+		uri, hasURI := buffer["uri"].(string)
+		length, _ := buffer["byteLength"].(float64)
+		return hasURI && !isEmbeddedURI(uri) && int64(length) > maxSize
+	})
+
+	viewRemap := removeGLTFElements(model, "bufferViews", func(view map[string]interface{}) bool {
+		if !remapGLTFIndex(view, "buffer", bufferRemap) {
+			return true
+		}
+		if meshopt, ok := extensionObject(view, "EXT_meshopt_compression"); ok {
+			return !remapGLTFIndex(meshopt, "buffer", bufferRemap)
+		}
+		return false
+	})
+
+	forEachGLTFElement(model, "accessors", func(accessor map[string]interface{}) {
+		if !remapGLTFIndex(accessor, "bufferView", viewRemap) {
+			delete(accessor, "byteOffset")
+		}
+		if sparse, ok := accessor["sparse"].(map[string]interface{}); ok {
+			indices, _ := sparse["indices"].(map[string]interface{})
+			values, _ := sparse["values"].(map[string]interface{})
+			if indices == nil || values == nil || !remapGLTFIndex(indices, "bufferView", viewRemap) || !remapGLTFIndex(values, "bufferView", viewRemap) {
+				delete(accessor, "sparse")
+			}
+		}
+	})
+
+	forEachGLTFElement(model, "meshes", func(mesh map[string]interface{}) {
+		forEachGLTFElement(mesh, "primitives", func(primitive map[string]interface{}) {
+			if draco, ok := extensionObject(primitive, "KHR_draco_mesh_compression"); ok && !remapGLTFIndex(draco, "bufferView", viewRemap) {
+				deleteExtension(primitive, "KHR_draco_mesh_compression")
+			}
+		})
+	})
+
+	imageRemap := removeGLTFElements(model, "images", func(image map[string]interface{}) bool {
+		return !remapGLTFIndex(image, "bufferView", viewRemap)
+	})
+
+	forEachGLTFElement(model, "textures", func(texture map[string]interface{}) {
+		remapGLTFIndex(texture, "source", imageRemap)
+		extensions, _ := texture["extensions"].(map[string]interface{})
+		for name := range extensions {
+			if extension, ok := extensionObject(texture, name); ok && !remapGLTFIndex(extension, "source", imageRemap) {
+				deleteExtension(texture, name)
+			}
+		}
+	})
+}
+
+// sanitizeGLTF applies the stripping rewrite options ask for to a parsed glTF document.
+func sanitizeGLTF(model map[string]interface{}, opts rewriteOptions) {
+	if opts.StripUnknownExtensions {
+		stripUnknownGLTFExtensions(model)
+	}
+	if opts.MaxBufferSize > 0 {
+		stripOversizedGLTFBuffers(model, opts.MaxBufferSize)
+	}
+}
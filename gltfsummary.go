@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// How much of an external image is downloaded to read its dimensions.
+const imageHeaderSize = 64 * 1024
+
+// How many external images are fetched at once while summarizing a glTF document.
+const summaryFetchConcurrency = 4
+
+// How many external images are fetched at most while summarizing a glTF document. Those past it
+// are reported without their dimensions and sizes.
+const maxSummaryImageFetches = 64
+
+// gltfImageSummary describes an image used by a glTF document. Dimensions and sizes which can't be
+// determined, e.g. of images in formats farspark can't decode, are left out.
+type gltfImageSummary struct {
+	URI      string `json:"uri,omitempty"` // absolute; empty for images embedded in the document
+	MimeType string `json:"mimeType,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	ByteSize int64  `json:"byteSize,omitempty"`
+}
+
+type gltfAnimationSummary struct {
+	Name     string  `json:"name,omitempty"`
+	Channels int     `json:"channels"`
+	Duration float64 `json:"duration"` // in seconds
+}
+
+// gltfSummary describes what's in a glTF document. Triangles and vertices are counted once per
+// mesh, however many nodes use it. ImageBytes only counts external images, since embedded ones
+// are already part of a buffer or the document.
+type gltfSummary struct {
+	Counts             map[string]int         `json:"counts"`
+	Triangles          int64                  `json:"triangles"`
+	Vertices           int64                  `json:"vertices"`
+	Images             []gltfImageSummary     `json:"images"`
+	Animations         []gltfAnimationSummary `json:"animations"`
+	ExtensionsUsed     []string               `json:"extensionsUsed"`
+	ExtensionsRequired []string               `json:"extensionsRequired"`
+	BufferBytes        int64                  `json:"bufferBytes"`
+	ImageBytes         int64                  `json:"imageBytes"`
+}
+
+// Top-level glTF collections which are counted in summaries.
+var gltfSummaryCollections = []string{
+	"accessors", "animations", "buffers", "cameras", "images", "materials", "meshes", "nodes", "scenes", "skins", "textures",
+}
+
+// fetchImageFunc downloads the start of an external image, returning it and the image's size, or
+// -1 if that isn't known.
+type fetchImageFunc func(imageURL string) ([]byte, int64, error)
+
+// fetchImageHeader fetches the start of an external image from its origin, if it's allowed.
+func fetchImageHeader(imageURL string) ([]byte, int64, error) {
+	if err := checkSourceURL(imageURL); err != nil {
+		return nil, -1, err
+	}
+	return downloadMediaPrefix(imageURL, imageHeaderSize)
+}
+
+// gltfModel is a parsed glTF document, for reading properties which may be missing or of the
+// wrong type.
+type gltfModel map[string]interface{}
+
+func (m gltfModel) element(collection string, index interface{}) map[string]interface{} {
+	elements, _ := m[collection].([]interface{})
+	i, ok := index.(float64)
+	if !ok || i < 0 || int(i) >= len(elements) {
+		return nil
+	}
+	element, _ := elements[int(i)].(map[string]interface{})
+	return element
+}
+
+func (m gltfModel) elements(collection string) []map[string]interface{} {
+	array, _ := m[collection].([]interface{})
+	elements := []map[string]interface{}{}
+	for _, element := range array {
+		if obj, ok := element.(map[string]interface{}); ok {
+			elements = append(elements, obj)
+		}
+	}
+	return elements
+}
+
+func numberProperty(obj map[string]interface{}, key string) int64 {
+	number, _ := obj[key].(float64)
+	return int64(number)
+}
+
+func stringList(value interface{}) []string {
+	array, _ := value.([]interface{})
+	list := []string{}
+	for _, element := range array {
+		if s, ok := element.(string); ok {
+			list = append(list, s)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// countPrimitive returns the number of triangles and vertices a mesh primitive draws.
+func (m gltfModel) countPrimitive(primitive map[string]interface{}) (int64, int64) {
+	attributes, _ := primitive["attributes"].(map[string]interface{})
+	vertices := numberProperty(m.element("accessors", attributes["POSITION"]), "count")
+
+	n := vertices
+	if indices := m.element("accessors", primitive["indices"]); indices != nil {
+		n = numberProperty(indices, "count")
+	}
+
+	mode := int64(4) // TRIANGLES
+	if _, ok := primitive["mode"]; ok {
+		mode = numberProperty(primitive, "mode")
+	}
+
+	switch {
+	case mode == 4:
+		return n / 3, vertices
+	case (mode == 5 || mode == 6) && n >= 3: // TRIANGLE_STRIP, TRIANGLE_FAN
+		return n - 2, vertices
+	default:
+		return 0, vertices
+	}
+}
+
+func (m gltfModel) summarizeAnimation(animation map[string]interface{}) gltfAnimationSummary {
+	summary := gltfAnimationSummary{}
+	summary.Name, _ = animation["name"].(string)
+	channels, _ := animation["channels"].([]interface{})
+	summary.Channels = len(channels)
+
+	samplers, _ := animation["samplers"].([]interface{})
+	for _, sampler := range samplers {
+		sampler, _ := sampler.(map[string]interface{})
+		input := m.element("accessors", sampler["input"])
+		// Animation input accessors must have their bounds, which are timestamps
+		bounds, _ := input["max"].([]interface{})
+		if len(bounds) > 0 {
+			if end, ok := bounds[0].(float64); ok && end > summary.Duration {
+				summary.Duration = end
+			}
+		}
+	}
+
+	return summary
+}
+
+// bufferViewData returns the data of a buffer view in a GLB's binary chunk, if it's in one.
+func (m gltfModel) bufferViewData(index interface{}, bin []byte) []byte {
+	view := m.element("bufferViews", index)
+	buffer := m.element("buffers", view["buffer"])
+	if view == nil || buffer == nil || view["buffer"] != 0.0 || buffer["uri"] != nil {
+		return nil
+	}
+	offset := numberProperty(view, "byteOffset")
+	length := numberProperty(view, "byteLength")
+	if offset < 0 || length < 0 || offset+length > int64(len(bin)) {
+		return nil
+	}
+	return bin[offset : offset+length]
+}
+
+// decodeDataURI returns the data in a base64 data: URI.
+func decodeDataURI(uri string) ([]byte, bool) {
+	comma := strings.Index(uri, ",")
+	if comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(uri[comma+1:])
+	return data, err == nil
+}
+
+func setImageDimensions(summary *gltfImageSummary, header []byte) {
+	if config, _, err := image.DecodeConfig(bytes.NewReader(header)); err == nil {
+		summary.Width = config.Width
+		summary.Height = config.Height
+	}
+}
+
+// summarizeImages describes a document's images, fetching the start of up to
+// maxSummaryImageFetches external ones with fetchImage to find their dimensions and sizes. No
+// fetches are started after deadline.
+func (m gltfModel) summarizeImages(baseURL *url.URL, bin []byte, fetchImage fetchImageFunc, deadline time.Time) []gltfImageSummary {
+	images := m.elements("images")
+	summaries := make([]gltfImageSummary, len(images))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, summaryFetchConcurrency)
+	fetches := 0
+
+	for i, img := range images {
+		summary := &summaries[i]
+		summary.MimeType, _ = img["mimeType"].(string)
+
+		uri, hasURI := img["uri"].(string)
+		if !hasURI {
+			if data := m.bufferViewData(img["bufferView"], bin); data != nil {
+				summary.ByteSize = int64(len(data))
+				setImageDimensions(summary, data)
+			} else if view := m.element("bufferViews", img["bufferView"]); view != nil {
+				summary.ByteSize = numberProperty(view, "byteLength")
+			}
+			continue
+		}
+
+		if isEmbeddedURI(uri) {
+			if data, ok := decodeDataURI(uri); ok {
+				summary.ByteSize = int64(len(data))
+				setImageDimensions(summary, data)
+			}
+			continue
+		}
+
+		imageURL, err := resolveReference(uri, baseURL)
+		if err != nil {
+			continue
+		}
+		summary.URI = imageURL
+
+		if fetches == maxSummaryImageFetches {
+			continue
+		}
+		fetches++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if time.Now().After(deadline) {
+				return
+			}
+			header, size, err := fetchImage(summary.URI)
+			if err != nil {
+				return
+			}
+			if size > 0 {
+				summary.ByteSize = size
+			}
+			setImageDimensions(summary, header)
+		}()
+	}
+
+	wg.Wait()
+	return summaries
+}
+
+// summarizeGLTF describes what's in a glTF document, or a GLB, fetched from baseURL. External
+// images are only fetched until deadline.
+func summarizeGLTF(data []byte, baseURL *url.URL, fetchImage fetchImageFunc, deadline time.Time) (*gltfSummary, error) {
+	var bin []byte
+	if isGLB(data) {
+		chunks, err := readGLBChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunks) > 1 {
+			bin = chunks[1].Data
+		}
+		data = chunks[0].Data
+	}
+
+	var m gltfModel
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	summary := &gltfSummary{
+		Counts:             make(map[string]int),
+		Animations:         []gltfAnimationSummary{},
+		ExtensionsUsed:     stringList(m["extensionsUsed"]),
+		ExtensionsRequired: stringList(m["extensionsRequired"]),
+	}
+
+	for _, collection := range gltfSummaryCollections {
+		summary.Counts[collection] = len(m.elements(collection))
+	}
+
+	for _, mesh := range m.elements("meshes") {
+		primitives, _ := mesh["primitives"].([]interface{})
+		for _, primitive := range primitives {
+			if primitive, ok := primitive.(map[string]interface{}); ok {
+				triangles, vertices := m.countPrimitive(primitive)
+				summary.Triangles += triangles
+				summary.Vertices += vertices
+			}
+		}
+	}
+
+	for _, animation := range m.elements("animations") {
+		summary.Animations = append(summary.Animations, m.summarizeAnimation(animation))
+	}
+
+	for _, buffer := range m.elements("buffers") {
+		summary.BufferBytes += numberProperty(buffer, "byteLength")
+	}
+
+	summary.Images = m.summarizeImages(baseURL, bin, fetchImage, deadline)
+	for _, img := range summary.Images {
+		if len(img.URI) > 0 {
+			summary.ImageBytes += img.ByteSize
+		}
+	}
+
+	return summary, nil
+}
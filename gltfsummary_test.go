@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func encodeTestPNG(t *testing.T, width int, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The header of a 3x2 lossless WebP, which is all that's needed to read its dimensions.
+var testWebPHeader = []byte("RIFF\x12\x00\x00\x00WEBPVP8L\x05\x00\x00\x00\x2f\x02\x40\x00\x00\x00")
+
+func Test_GLTF_summary(t *testing.T) {
+	embedded := encodeTestPNG(t, 16, 8)
+	inline := encodeTestPNG(t, 4, 4)
+	external := encodeTestPNG(t, 1024, 512)
+
+	json := fmt.Sprintf(`{
+		"asset": {"version": "2.0"},
+		"extensionsUsed": ["KHR_texture_transform", "EXT_texture_webp"],
+		"scenes": [{"nodes": [0, 1]}],
+		"nodes": [{"mesh": 0}, {"mesh": 0}],
+		"meshes": [{"primitives": [
+			{"attributes": {"POSITION": 0}, "indices": 1},
+			{"attributes": {"POSITION": 2}, "mode": 5}
+		]}],
+		"materials": [{}],
+		"animations": [{"name": "wave", "channels": [{}, {}], "samplers": [{"input": 3}]}],
+		"accessors": [
+			{"count": 4, "type": "VEC3"},
+			{"count": 6, "type": "SCALAR"},
+			{"count": 5, "type": "VEC3"},
+			{"count": 10, "type": "SCALAR", "max": [2.5]}
+		],
+		"images": [
+			{"bufferView": 0, "mimeType": "image/png"},
+			{"uri": "data:image/png;base64,%s"},
+			{"uri": "textures/big.png"},
+			{"uri": "textures/missing.ktx2"},
+			{"uri": "data:image/webp;base64,%s"}
+		],
+		"bufferViews": [{"buffer": 0, "byteOffset": 0, "byteLength": %d}],
+		"buffers": [{"byteLength": %d}, {"uri": "data.bin", "byteLength": 1000}]
+	}`, base64.StdEncoding.EncodeToString(inline), base64.StdEncoding.EncodeToString(testWebPHeader), len(embedded), len(embedded))
+
+	fetchImage := func(imageURL string) ([]byte, int64, error) {
+		if imageURL != "https://example.com/models/textures/big.png" {
+			return nil, -1, errors.New("Not found")
+		}
+		return external[:64], 300000, nil
+	}
+
+	baseURL, _ := url.Parse("https://example.com/models/model.glb")
+	summary, err := summarizeGLTF(writeGLB([]glbChunk{{glbChunkJSON, []byte(json)}, {glbChunkBIN, embedded}}), baseURL, fetchImage, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Counts["nodes"] != 2 || summary.Counts["meshes"] != 1 || summary.Counts["materials"] != 1 || summary.Counts["images"] != 5 {
+		t.Fatalf("Unexpected counts %v", summary.Counts)
+	}
+	if summary.Triangles != 5 || summary.Vertices != 9 {
+		t.Fatalf("Expected 5 triangles and 9 vertices, got %d and %d", summary.Triangles, summary.Vertices)
+	}
+	if !reflect.DeepEqual(summary.ExtensionsUsed, []string{"EXT_texture_webp", "KHR_texture_transform"}) {
+		t.Fatalf("Unexpected extensions %v", summary.ExtensionsUsed)
+	}
+	if !reflect.DeepEqual(summary.Animations, []gltfAnimationSummary{{"wave", 2, 2.5}}) {
+		t.Fatalf("Unexpected animations %+v", summary.Animations)
+	}
+
+	expectedImages := []gltfImageSummary{
+		{MimeType: "image/png", Width: 16, Height: 8, ByteSize: int64(len(embedded))},
+		{Width: 4, Height: 4, ByteSize: int64(len(inline))},
+		{URI: "https://example.com/models/textures/big.png", Width: 1024, Height: 512, ByteSize: 300000},
+		{URI: "https://example.com/models/textures/missing.ktx2"},
+		{Width: 3, Height: 2, ByteSize: int64(len(testWebPHeader))},
+	}
+	if !reflect.DeepEqual(summary.Images, expectedImages) {
+		t.Fatalf("Unexpected images %+v", summary.Images)
+	}
+
+	if summary.BufferBytes != int64(len(embedded))+1000 || summary.ImageBytes != 300000 {
+		t.Fatalf("Unexpected byte sizes: %d of buffers, %d of images", summary.BufferBytes, summary.ImageBytes)
+	}
+}
+
+func Test_GLTF_summary_image_limits(t *testing.T) {
+	var images []string
+	for i := 0; i < maxSummaryImageFetches+10; i++ {
+		images = append(images, fmt.Sprintf(`{"uri": "%d.png"}`, i))
+	}
+	json := `{"asset": {"version": "2.0"}, "images": [` + strings.Join(images, ",") + `]}`
+
+	var mutex sync.Mutex
+	fetches := 0
+	fetchImage := func(imageURL string) ([]byte, int64, error) {
+		mutex.Lock()
+		fetches++
+		mutex.Unlock()
+		return nil, 100, nil
+	}
+
+	baseURL, _ := url.Parse("https://example.com/models/model.gltf")
+	summary, err := summarizeGLTF([]byte(json), baseURL, fetchImage, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != maxSummaryImageFetches || summary.ImageBytes != 100*maxSummaryImageFetches {
+		t.Fatalf("Expected %d images to be fetched, got %d", maxSummaryImageFetches, fetches)
+	}
+
+	fetches = 0
+	if _, err := summarizeGLTF([]byte(json), baseURL, fetchImage, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 0 {
+		t.Fatalf("Expected no images to be fetched past the deadline, got %d", fetches)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// gltfIssue is a problem found in a glTF document. Pointer is a JSON pointer to where it is.
+type gltfIssue struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// gltfReport is the result of validating a glTF document.
+type gltfReport struct {
+	Valid    bool        `json:"valid"`
+	Errors   []gltfIssue `json:"errors"`
+	Warnings []gltfIssue `json:"warnings"`
+}
+
+// Extensions farspark knows clients can handle; others are reported, and can be stripped.
+var knownGLTFExtensions = map[string]bool{
+	"EXT_mesh_gpu_instancing":         true,
+	"EXT_meshopt_compression":         true,
+	"EXT_texture_webp":                true,
+	"KHR_audio":                       true,
+	"KHR_draco_mesh_compression":      true,
+	"KHR_lights_punctual":             true,
+	"KHR_materials_clearcoat":         true,
+	"KHR_materials_emissive_strength": true,
+	"KHR_materials_ior":               true,
+	"KHR_materials_iridescence":       true,
+	"KHR_materials_sheen":             true,
+	"KHR_materials_specular":          true,
+	"KHR_materials_transmission":      true,
+	"KHR_materials_unlit":             true,
+	"KHR_materials_variants":          true,
+	"KHR_materials_volume":            true,
+	"KHR_mesh_quantization":           true,
+	"KHR_texture_basisu":              true,
+	"KHR_texture_transform":           true,
+	"MOZ_hubs_components":             true,
+	"MOZ_lightmap":                    true,
+	"MOZ_texture_rgbe":                true,
+	"MSFT_audio_emitter":              true,
+	"MSFT_lod":                        true,
+	"MSFT_texture_dds":                true,
+}
+
+// Map from accessor component type to its size in bytes.
+var gltfComponentSizes = map[int64]int64{
+	5120: 1, // BYTE
+	5121: 1, // UNSIGNED_BYTE
+	5122: 2, // SHORT
+	5123: 2, // UNSIGNED_SHORT
+	5125: 4, // UNSIGNED_INT
+	5126: 4, // FLOAT
+}
+
+// Map from accessor type to its number of rows and columns.
+var gltfAccessorTypes = map[string][2]int64{
+	"SCALAR": {1, 1},
+	"VEC2":   {2, 1},
+	"VEC3":   {3, 1},
+	"VEC4":   {4, 1},
+	"MAT2":   {2, 2},
+	"MAT3":   {3, 3},
+	"MAT4":   {4, 4},
+}
+
+// Material properties which are texture references.
+var gltfMaterialTextures = [][]string{
+	{"pbrMetallicRoughness", "baseColorTexture"},
+	{"pbrMetallicRoughness", "metallicRoughnessTexture"},
+	{"normalTexture"},
+	{"occlusionTexture"},
+	{"emissiveTexture"},
+}
+
+type gltfValidator struct {
+	model     map[string]interface{}
+	report    *gltfReport
+	binLength int64 // length of a GLB's binary chunk, or -1 if there isn't one
+}
+
+func (v *gltfValidator) errorf(pointer string, format string, args ...interface{}) {
+	v.report.Errors = append(v.report.Errors, gltfIssue{pointer, fmt.Sprintf(format, args...)})
+}
+
+func (v *gltfValidator) warnf(pointer string, format string, args ...interface{}) {
+	v.report.Warnings = append(v.report.Warnings, gltfIssue{pointer, fmt.Sprintf(format, args...)})
+}
+
+// elements returns the objects in the top-level array collection.
+func (v *gltfValidator) elements(collection string) []map[string]interface{} {
+	return v.objects(v.model, collection, "")
+}
+
+// objects returns the objects in the array at key of obj, reporting anything else found there.
+func (v *gltfValidator) objects(obj map[string]interface{}, key string, pointer string) []map[string]interface{} {
+	value, ok := obj[key]
+	if !ok {
+		return nil
+	}
+
+	array, ok := value.([]interface{})
+	if !ok {
+		v.errorf(pointer+"/"+key, "Expected an array")
+		return nil
+	}
+
+	elements := make([]map[string]interface{}, len(array))
+	for i, element := range array {
+		if elements[i], ok = element.(map[string]interface{}); !ok {
+			v.errorf(fmt.Sprintf("%s/%s/%d", pointer, key, i), "Expected an object")
+			elements[i] = map[string]interface{}{}
+		}
+	}
+	return elements
+}
+
+func (v *gltfValidator) count(collection string) int {
+	array, _ := v.model[collection].([]interface{})
+	return len(array)
+}
+
+// integer returns the non-negative integer at key of obj, reporting it if it's missing but
+// required, or isn't a non-negative integer.
+func (v *gltfValidator) integer(obj map[string]interface{}, key string, pointer string, required bool) (int64, bool) {
+	value, ok := obj[key]
+	if !ok {
+		if required {
+			v.errorf(pointer, "Missing required property %s", key)
+		}
+		return 0, false
+	}
+
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) || number > math.MaxInt64 {
+		v.errorf(pointer+"/"+key, "Expected a non-negative integer")
+		return 0, false
+	}
+	return int64(number), true
+}
+
+// index returns the index at key of obj, reporting it if it doesn't refer to an element of the
+// top-level array collection.
+func (v *gltfValidator) index(obj map[string]interface{}, key string, pointer string, collection string, required bool) (int64, bool) {
+	i, ok := v.integer(obj, key, pointer, required)
+	if !ok {
+		return 0, false
+	}
+	if i >= int64(v.count(collection)) {
+		v.errorf(pointer+"/"+key, "Index %d is out of range; there are %d %s", i, v.count(collection), collection)
+		return 0, false
+	}
+	return i, true
+}
+
+func (v *gltfValidator) validateAsset() {
+	asset, ok := v.model["asset"].(map[string]interface{})
+	if !ok {
+		v.errorf("", "Missing required property asset")
+		return
+	}
+
+	version, ok := asset["version"].(string)
+	if !ok {
+		v.errorf("/asset", "Missing required property version")
+	} else if !strings.HasPrefix(version, "2.") {
+		v.errorf("/asset/version", "Unsupported glTF version %s", version)
+	}
+}
+
+func (v *gltfValidator) validateExtensions() {
+	used := make(map[string]bool)
+	if array, ok := v.model["extensionsUsed"].([]interface{}); ok {
+		for i, value := range array {
+			name, _ := value.(string)
+			used[name] = true
+			if !knownGLTFExtensions[name] {
+				v.warnf(fmt.Sprintf("/extensionsUsed/%d", i), "Unknown extension %s", name)
+			}
+		}
+	}
+
+	if array, ok := v.model["extensionsRequired"].([]interface{}); ok {
+		for i, value := range array {
+			name, _ := value.(string)
+			if !used[name] {
+				v.errorf(fmt.Sprintf("/extensionsRequired/%d", i), "Required extension %s is missing from extensionsUsed", name)
+			}
+			if !knownGLTFExtensions[name] {
+				v.errorf(fmt.Sprintf("/extensionsRequired/%d", i), "Unknown extension %s is required", name)
+			}
+		}
+	}
+}
+
+// dataURILength returns the length of the data in a base64 data: URI, or -1 if it isn't one.
+func dataURILength(uri string) int64 {
+	comma := strings.Index(uri, ",")
+	if !isEmbeddedURI(uri) || comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+		return -1
+	}
+	payload := strings.TrimRight(uri[comma+1:], "=")
+	return int64(len(payload)) * 3 / 4
+}
+
+// validateBuffers checks buffers and returns their lengths, which are -1 where they're missing.
+func (v *gltfValidator) validateBuffers() []int64 {
+	buffers := v.elements("buffers")
+	lengths := make([]int64, len(buffers))
+
+	for i, buffer := range buffers {
+		pointer := fmt.Sprintf("/buffers/%d", i)
+		length, ok := v.integer(buffer, "byteLength", pointer, true)
+		if !ok {
+			length = -1
+		} else if length < 1 {
+			v.errorf(pointer+"/byteLength", "Buffer must not be empty")
+		}
+		lengths[i] = length
+
+		uri, hasURI := buffer["uri"].(string)
+		switch {
+		case !hasURI && (i > 0 || v.binLength < 0):
+			v.errorf(pointer, "Buffer has no uri, and isn't a GLB's binary chunk")
+		case !hasURI && length > v.binLength:
+			v.errorf(pointer+"/byteLength", "Buffer is %d bytes long, but the GLB's binary chunk is only %d", length, v.binLength)
+		case hasURI && dataURILength(uri) >= 0 && dataURILength(uri) < length:
+			v.errorf(pointer+"/uri", "Buffer is %d bytes long, but its data URI only holds %d", length, dataURILength(uri))
+		}
+	}
+
+	return lengths
+}
+
+// validateBufferViews checks buffer views against the given buffer lengths, and returns their
+// lengths, which are -1 where they're missing, and strides.
+func (v *gltfValidator) validateBufferViews(bufferLengths []int64) ([]int64, []int64) {
+	views := v.elements("bufferViews")
+	lengths := make([]int64, len(views))
+	strides := make([]int64, len(views))
+
+	for i, view := range views {
+		pointer := fmt.Sprintf("/bufferViews/%d", i)
+		buffer, hasBuffer := v.index(view, "buffer", pointer, "buffers", true)
+		offset, _ := v.integer(view, "byteOffset", pointer, false)
+		length, ok := v.integer(view, "byteLength", pointer, true)
+		if !ok {
+			length = -1
+		} else if length < 1 {
+			v.errorf(pointer+"/byteLength", "Buffer view must not be empty")
+		}
+		lengths[i] = length
+
+		if stride, ok := v.integer(view, "byteStride", pointer, false); ok {
+			if stride < 4 || stride > 252 || stride%4 != 0 {
+				v.errorf(pointer+"/byteStride", "Stride must be a multiple of 4 between 4 and 252")
+			}
+			strides[i] = stride
+		}
+
+		if hasBuffer && length >= 0 && bufferLengths[buffer] >= 0 && offset+length > bufferLengths[buffer] {
+			v.errorf(pointer, "Buffer view ends at byte %d, past the end of buffer %d, which is %d bytes long", offset+length, buffer, bufferLengths[buffer])
+		}
+	}
+
+	return lengths, strides
+}
+
+func (v *gltfValidator) validateAccessors(viewLengths []int64, viewStrides []int64) {
+	for i, accessor := range v.elements("accessors") {
+		pointer := fmt.Sprintf("/accessors/%d", i)
+
+		componentType, hasComponentType := v.integer(accessor, "componentType", pointer, true)
+		componentSize, ok := gltfComponentSizes[componentType]
+		if hasComponentType && !ok {
+			v.errorf(pointer+"/componentType", "Invalid component type %d", componentType)
+		}
+
+		accessorType, _ := accessor["type"].(string)
+		dimensions, hasType := gltfAccessorTypes[accessorType]
+		if !hasType {
+			v.errorf(pointer, "Missing or invalid type %q", accessorType)
+		}
+
+		count, hasCount := v.integer(accessor, "count", pointer, true)
+		if hasCount && count < 1 {
+			v.errorf(pointer+"/count", "Count must be at least 1")
+		}
+
+		offset, _ := v.integer(accessor, "byteOffset", pointer, false)
+		view, hasView := v.index(accessor, "bufferView", pointer, "bufferViews", false)
+
+		if !hasView || viewLengths[view] < 0 || componentSize == 0 || !hasType || count < 1 {
+			continue
+		}
+
+		if offset%componentSize != 0 {
+			v.errorf(pointer+"/byteOffset", "Offset must be a multiple of the component size, %d", componentSize)
+		}
+
+		// Matrix columns are padded to 4 bytes
+		columnSize := componentSize * dimensions[0]
+		if dimensions[1] > 1 && columnSize%4 != 0 {
+			columnSize += 4 - columnSize%4
+		}
+		elementSize := columnSize * dimensions[1]
+
+		stride := viewStrides[view]
+		if stride == 0 {
+			stride = elementSize
+		}
+
+		if end := offset + stride*(count-1) + elementSize; end > viewLengths[view] {
+			v.errorf(pointer, "Accessor ends at byte %d, past the end of buffer view %d, which is %d bytes long", end, view, viewLengths[view])
+		}
+	}
+}
+
+func (v *gltfValidator) validateMeshes() {
+	for i, mesh := range v.elements("meshes") {
+		pointer := fmt.Sprintf("/meshes/%d", i)
+		primitives := v.objects(mesh, "primitives", pointer)
+		if len(primitives) == 0 {
+			v.errorf(pointer, "Mesh has no primitives")
+		}
+
+		for j, primitive := range primitives {
+			primitivePointer := fmt.Sprintf("%s/primitives/%d", pointer, j)
+			attributes, ok := primitive["attributes"].(map[string]interface{})
+			if !ok {
+				v.errorf(primitivePointer, "Missing required property attributes")
+			}
+			for name := range attributes {
+				v.index(attributes, name, primitivePointer+"/attributes", "accessors", true)
+			}
+			v.index(primitive, "indices", primitivePointer, "accessors", false)
+			v.index(primitive, "material", primitivePointer, "materials", false)
+		}
+	}
+}
+
+func (v *gltfValidator) validateNodes() {
+	for i, node := range v.elements("nodes") {
+		pointer := fmt.Sprintf("/nodes/%d", i)
+		v.index(node, "mesh", pointer, "meshes", false)
+		v.index(node, "camera", pointer, "cameras", false)
+		v.index(node, "skin", pointer, "skins", false)
+
+		if children, ok := node["children"].([]interface{}); ok {
+			for j, child := range children {
+				childPointer := fmt.Sprintf("%s/children/%d", pointer, j)
+				if index, ok := child.(float64); !ok || index < 0 || int(index) >= v.count("nodes") {
+					v.errorf(childPointer, "Invalid node index %v", child)
+				} else if int(index) == i {
+					v.errorf(childPointer, "Node is its own child")
+				}
+			}
+		}
+	}
+
+	for i, scene := range v.elements("scenes") {
+		if nodes, ok := scene["nodes"].([]interface{}); ok {
+			for j, node := range nodes {
+				if index, ok := node.(float64); !ok || index < 0 || int(index) >= v.count("nodes") {
+					v.errorf(fmt.Sprintf("/scenes/%d/nodes/%d", i, j), "Invalid node index %v", node)
+				}
+			}
+		}
+	}
+	v.index(v.model, "scene", "", "scenes", false)
+
+	for i, skin := range v.elements("skins") {
+		pointer := fmt.Sprintf("/skins/%d", i)
+		v.index(skin, "inverseBindMatrices", pointer, "accessors", false)
+		v.index(skin, "skeleton", pointer, "nodes", false)
+		joints, ok := skin["joints"].([]interface{})
+		if !ok || len(joints) == 0 {
+			v.errorf(pointer, "Missing required property joints")
+		}
+		for j, joint := range joints {
+			if index, ok := joint.(float64); !ok || index < 0 || int(index) >= v.count("nodes") {
+				v.errorf(fmt.Sprintf("%s/joints/%d", pointer, j), "Invalid node index %v", joint)
+			}
+		}
+	}
+}
+
+func (v *gltfValidator) validateMaterials() {
+	for i, material := range v.elements("materials") {
+		for _, property := range gltfMaterialTextures {
+			pointer := fmt.Sprintf("/materials/%d", i)
+			textureInfo := material
+			for _, key := range property {
+				textureInfo, _ = textureInfo[key].(map[string]interface{})
+				pointer += "/" + key
+			}
+			if textureInfo != nil {
+				v.index(textureInfo, "index", pointer, "textures", true)
+			}
+		}
+	}
+
+	for i, texture := range v.elements("textures") {
+		pointer := fmt.Sprintf("/textures/%d", i)
+		v.index(texture, "source", pointer, "images", false)
+		v.index(texture, "sampler", pointer, "samplers", false)
+	}
+
+	for i, image := range v.elements("images") {
+		pointer := fmt.Sprintf("/images/%d", i)
+		_, hasURI := image["uri"].(string)
+		_, hasView := v.index(image, "bufferView", pointer, "bufferViews", false)
+		_, hasMimeType := image["mimeType"].(string)
+
+		if hasURI == hasView {
+			v.errorf(pointer, "Image must have exactly one of uri and bufferView")
+		}
+		if hasView && !hasMimeType {
+			v.errorf(pointer, "Image stored in a buffer view must have a mimeType")
+		}
+	}
+}
+
+func (v *gltfValidator) validateAnimations() {
+	for i, animation := range v.elements("animations") {
+		pointer := fmt.Sprintf("/animations/%d", i)
+		samplers := v.objects(animation, "samplers", pointer)
+
+		for j, sampler := range samplers {
+			samplerPointer := fmt.Sprintf("%s/samplers/%d", pointer, j)
+			v.index(sampler, "input", samplerPointer, "accessors", true)
+			v.index(sampler, "output", samplerPointer, "accessors", true)
+		}
+
+		for j, channel := range v.objects(animation, "channels", pointer) {
+			channelPointer := fmt.Sprintf("%s/channels/%d", pointer, j)
+			if sampler, ok := v.integer(channel, "sampler", channelPointer, true); ok && sampler >= int64(len(samplers)) {
+				v.errorf(channelPointer+"/sampler", "Index %d is out of range; there are %d samplers", sampler, len(samplers))
+			}
+			if target, ok := channel["target"].(map[string]interface{}); ok {
+				v.index(target, "node", channelPointer+"/target", "nodes", false)
+			} else {
+				v.errorf(channelPointer, "Missing required property target")
+			}
+		}
+	}
+}
+
+// validateGLTF checks the structure of a glTF document, or a GLB, and reports what's wrong with
+// it. Only documents which can't be parsed at all are returned as errors.
+func validateGLTF(data []byte) (*gltfReport, error) {
+	v := &gltfValidator{
+		report:    &gltfReport{Errors: []gltfIssue{}, Warnings: []gltfIssue{}},
+		binLength: -1,
+	}
+
+	if isGLB(data) {
+		chunks, err := readGLBChunks(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunks) > 1 {
+			v.binLength = int64(len(chunks[1].Data))
+		}
+		data = chunks[0].Data
+	}
+
+	if err := json.Unmarshal(data, &v.model); err != nil {
+		return nil, err
+	}
+
+	v.validateAsset()
+	v.validateExtensions()
+	bufferLengths := v.validateBuffers()
+	viewLengths, viewStrides := v.validateBufferViews(bufferLengths)
+	v.validateAccessors(viewLengths, viewStrides)
+	v.validateMeshes()
+	v.validateNodes()
+	v.validateMaterials()
+	v.validateAnimations()
+
+	v.report.Valid = len(v.report.Errors) == 0
+	return v.report, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+// A triangle, with positions in buffer 0 and indices in buffer 1.
+const validTestGLTF = `{
+	"asset": {"version": "2.0"},
+	"scene": 0,
+	"scenes": [{"nodes": [0]}],
+	"nodes": [{"mesh": 0}],
+	"meshes": [{"primitives": [{"attributes": {"POSITION": 0}, "indices": 1, "material": 0}]}],
+	"materials": [{"pbrMetallicRoughness": {"baseColorTexture": {"index": 0}}}],
+	"textures": [{"source": 0}],
+	"images": [{"uri": "texture.png"}],
+	"accessors": [
+		{"bufferView": 0, "componentType": 5126, "count": 3, "type": "VEC3"},
+		{"bufferView": 1, "componentType": 5123, "count": 3, "type": "SCALAR"}
+	],
+	"bufferViews": [
+		{"buffer": 0, "byteLength": 36},
+		{"buffer": 1, "byteLength": 6}
+	],
+	"buffers": [
+		{"uri": "positions.bin", "byteLength": 36},
+		{"uri": "indices.bin", "byteLength": 8}
+	]
+}`
+
+func Test_GLTF_validate(t *testing.T) {
+	report, err := validateGLTF([]byte(validTestGLTF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || len(report.Errors) > 0 || len(report.Warnings) > 0 {
+		t.Fatalf("Expected a valid report, got %+v", report)
+	}
+}
+
+func Test_GLTF_validate_errors(t *testing.T) {
+	var model map[string]interface{}
+	json.Unmarshal([]byte(validTestGLTF), &model)
+
+	model["nodes"] = []interface{}{map[string]interface{}{"mesh": 3.0}}
+	model["accessors"].([]interface{})[0].(map[string]interface{})["count"] = 4.0
+	model["extensionsUsed"] = []interface{}{"EXT_unknown"}
+	delete(model["bufferViews"].([]interface{})[1].(map[string]interface{}), "byteLength")
+
+	data, _ := json.Marshal(model)
+	report, err := validateGLTF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid {
+		t.Fatal("Expected an invalid report")
+	}
+
+	expected := map[string]bool{
+		"/nodes/0/mesh":  true,
+		"/accessors/0":   true,
+		"/bufferViews/1": true,
+	}
+	for _, issue := range report.Errors {
+		if !expected[issue.Pointer] {
+			t.Fatalf("Unexpected error %+v", issue)
+		}
+		delete(expected, issue.Pointer)
+	}
+	if len(expected) > 0 {
+		t.Fatalf("Missing errors at %v", expected)
+	}
+
+	if len(report.Warnings) != 1 || report.Warnings[0].Pointer != "/extensionsUsed/0" {
+		t.Fatalf("Expected a warning about the unknown extension, got %+v", report.Warnings)
+	}
+}
+
+func Test_GLB_validate(t *testing.T) {
+	json := []byte(`{"asset":{"version":"2.0"},"buffers":[{"byteLength":16}],"bufferViews":[{"buffer":0,"byteLength":16}]}`)
+
+	report, err := validateGLTF(writeGLB([]glbChunk{{glbChunkJSON, json}, {glbChunkBIN, make([]byte, 8)}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Pointer != "/buffers/0/byteLength" {
+		t.Fatalf("Expected the buffer to be longer than the binary chunk, got %+v", report.Errors)
+	}
+
+	if _, err := validateGLTF([]byte("not a glTF document")); err == nil {
+		t.Fatal("Expected unparseable input to be rejected")
+	}
+}
+
+func Test_GLTF_sanitize(t *testing.T) {
+	in := []byte(`{"asset":{"version":"2.0"},` +
+		`"extensionsUsed":["EXT_unknown","KHR_texture_transform"],` +
+		`"materials":[{"extensions":{"EXT_unknown":{}},"pbrMetallicRoughness":{"baseColorTexture":{"index":0,"extensions":{"KHR_texture_transform":{}}}}}],` +
+		`"textures":[{"source":1},{"source":0}],` +
+		`"images":[{"bufferView":0,"mimeType":"image/png"},{"bufferView":1,"mimeType":"image/png"}],` +
+		`"accessors":[{"bufferView":2,"byteOffset":4,"componentType":5126,"count":1,"type":"SCALAR"}],` +
+		`"bufferViews":[{"buffer":0,"byteLength":4},{"buffer":1,"byteLength":4},{"buffer":0,"byteLength":8}],` +
+		`"buffers":[{"uri":"huge.bin","byteLength":4096},{"uri":"small.bin","byteLength":4}]}`)
+	expected := `{"accessors":[{"componentType":5126,"count":1,"type":"SCALAR"}],"asset":{"version":"2.0"},` +
+		`"bufferViews":[{"buffer":0,"byteLength":4}],"buffers":[{"byteLength":4,"uri":"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9tb2RlbHMvc21hbGwuYmlu"}],` +
+		`"extensionsUsed":["KHR_texture_transform"],"images":[{"bufferView":0,"mimeType":"image/png"}],` +
+		`"materials":[{"pbrMetallicRoughness":{"baseColorTexture":{"extensions":{"KHR_texture_transform":{}},"index":0}}}],` +
+		`"textures":[{"source":0},{}]}`
+
+	baseURL, _ := url.Parse("https://example.com/models/model.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	result, err := processGLTF(in, baseURL, serverURL, rewriteOptions{StripUnknownExtensions: true, MaxBufferSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != expected {
+		t.Fatalf("Unexpected output:\n%s\nexpected:\n%s", result, expected)
+	}
+
+	report, err := validateGLTF(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid {
+		t.Fatalf("Expected the sanitized document to be valid, got %+v", report.Errors)
+	}
+}
+
+func Test_GLTF_sanitize_required_extensions(t *testing.T) {
+	model := map[string]interface{}{
+		"extensionsUsed":     []interface{}{"EXT_unknown", "KHR_texture_transform"},
+		"extensionsRequired": []interface{}{"EXT_unknown"},
+		"meshes":             []interface{}{map[string]interface{}{"extensions": map[string]interface{}{"EXT_unknown": map[string]interface{}{}}}},
+	}
+	expected, _ := json.Marshal(model)
+
+	stripUnknownGLTFExtensions(model)
+	if result, _ := json.Marshal(model); string(result) != string(expected) {
+		t.Fatalf("Expected a document requiring an unknown extension to be left alone, got %s", result)
+	}
+}
@@ -13,8 +13,9 @@ pkg_bin_dirs=(bin)
 pkg_deps=(core/glibc/2.27/20180608041157
           core/gcc-libs/7.3.0/20180608091701
           core/bash/4.4.19/20180608092913
-          mozillareality/ghostscript)
-pkg_build_deps=(mozillareality/ghostscript)
+          mozillareality/ghostscript
+          core/ffmpeg)
+pkg_build_deps=()
 pkg_scaffolding=core/scaffolding-go/0.1.0/20181218162103
 scaffolding_go_base_path=github.com/MozillaReality/farspark
 scaffolding_go_build_deps=()
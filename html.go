@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlTagRegexp       = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9-]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+))?)*)(\s*/?>)`)
+	htmlAttributeRegexp = regexp.MustCompile(`(\s+)([^\s"'>/=]+)(\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// Map from HTML element to its attributes which load subresources, which are proxied.
+var htmlSubresourceAttributes = map[string][]string{
+	"img":    {"src", "srcset"},
+	"source": {"src", "srcset"},
+	"script": {"src"},
+	"link":   {"href"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"track":  {"src"},
+	"iframe": {"src"},
+	"embed":  {"src"},
+	"object": {"data"},
+	"input":  {"src"},
+}
+
+// Map from HTML element to its attributes which link to other pages. Those aren't proxied, but
+// are made absolute so they still point at the right place.
+var htmlLinkAttributes = map[string][]string{
+	"a":    {"href"},
+	"area": {"href"},
+	"form": {"action"},
+	"base": {"href"},
+}
+
+// isHTTPReference reports whether ref, relative to baseURL, is an HTTP(S) URL, rather than e.g. a
+// fragment, a data: URI or javascript.
+func isHTTPReference(ref string, baseURL *url.URL) bool {
+	trimmed := strings.TrimSpace(ref)
+	if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+		return false
+	}
+	refURL, err := url.Parse(trimmed)
+	if err != nil {
+		return false
+	}
+	scheme := baseURL.ResolveReference(refURL).Scheme
+	return scheme == "http" || scheme == "https"
+}
+
+// rewriteSrcset rewrites each URL of a srcset attribute, keeping its descriptors.
+func rewriteSrcset(srcset string, baseURL *url.URL, serverURL *url.URL) (string, error) {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 || !isHTTPReference(fields[0], baseURL) {
+			continue
+		}
+		newURL, err := rewriteReference(fields[0], baseURL, serverURL)
+		if err != nil {
+			return "", err
+		}
+		fields[0] = newURL
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", "), nil
+}
+
+// Elements whose contents are text rather than markup, e.g. scripts and stylesheets, so tags in
+// them aren't rewritten. The contents of <plaintext> run to the end of the page.
+var htmlRawTextElements = map[string]bool{
+	"script":    true,
+	"style":     true,
+	"textarea":  true,
+	"title":     true,
+	"xmp":       true,
+	"iframe":    true,
+	"noembed":   true,
+	"noframes":  true,
+	"plaintext": true,
+}
+
+// rewriteHTML rewrites the subresources loaded by an HTML page, e.g. images, scripts and
+// stylesheets, and makes its links absolute. A <base> element changes what the references after it
+// are relative to. Comments and the contents of raw text elements like <script> and <style> are
+// left as they are.
+func rewriteHTML(data []byte, baseURL *url.URL, serverURL *url.URL, _ rewriteOptions) ([]byte, error) {
+	page := string(data)
+	var result bytes.Buffer
+
+	for len(page) > 0 {
+		start := strings.IndexByte(page, '<')
+		if start < 0 {
+			result.WriteString(page)
+			break
+		}
+		result.WriteString(page[:start])
+		page = page[start:]
+
+		if strings.HasPrefix(page, "<!--") {
+			end := strings.Index(page[4:], "-->")
+			if end < 0 {
+				end = len(page)
+			} else {
+				end += 4 + len("-->")
+			}
+			result.WriteString(page[:end])
+			page = page[end:]
+			continue
+		}
+
+		match := htmlTagRegexp.FindStringSubmatchIndex(page)
+		if match == nil || match[0] != 0 {
+			result.WriteByte('<')
+			page = page[1:]
+			continue
+		}
+
+		element := strings.ToLower(page[match[2]:match[3]])
+		tag, err := rewriteHTMLTag(page[:match[1]], &baseURL, serverURL)
+		if err != nil {
+			return nil, err
+		}
+		result.WriteString(tag)
+		page = page[match[1]:]
+
+		if htmlRawTextElements[element] {
+			end := len(page)
+			if element != "plaintext" {
+				if i := strings.Index(strings.ToLower(page), "</"+element); i >= 0 {
+					end = i
+				}
+			}
+			result.WriteString(page[:end])
+			page = page[end:]
+		}
+	}
+
+	return result.Bytes(), nil
+}
+
+// rewriteHTMLTag rewrites the references in the attributes of a start tag. A <base> tag changes
+// *baseURL.
+func rewriteHTMLTag(tag string, baseURL **url.URL, serverURL *url.URL) (string, error) {
+	parts := htmlTagRegexp.FindStringSubmatch(tag)
+	element := strings.ToLower(parts[1])
+	subresourceAttributes := htmlSubresourceAttributes[element]
+	linkAttributes := htmlLinkAttributes[element]
+
+	if len(subresourceAttributes) == 0 && len(linkAttributes) == 0 {
+		return tag, nil
+	}
+
+	var rewriteErr error
+	attributes := htmlAttributeRegexp.ReplaceAllStringFunc(parts[2], func(attribute string) string {
+		attrParts := htmlAttributeRegexp.FindStringSubmatch(attribute)
+		name := strings.ToLower(attrParts[2])
+		value := html.UnescapeString(strings.Trim(attrParts[4], `"'`))
+
+		var newValue string
+		var err error
+		switch {
+		case rewriteErr != nil:
+			return attribute
+		case containsString(subresourceAttributes, name) && name == "srcset":
+			newValue, err = rewriteSrcset(value, *baseURL, serverURL)
+		case containsString(subresourceAttributes, name) && isHTTPReference(value, *baseURL):
+			newValue, err = rewriteReference(strings.TrimSpace(value), *baseURL, serverURL)
+		case containsString(linkAttributes, name) && isHTTPReference(value, *baseURL):
+			newValue, err = resolveReference(strings.TrimSpace(value), *baseURL)
+			if err == nil && element == "base" {
+				*baseURL, err = url.Parse(newValue)
+			}
+		default:
+			return attribute
+		}
+
+		if err != nil {
+			rewriteErr = err
+			return attribute
+		}
+
+		return attrParts[1] + attrParts[2] + attrParts[3] + `"` + html.EscapeString(newValue) + `"`
+	})
+
+	if rewriteErr != nil {
+		return "", rewriteErr
+	}
+
+	return "<" + parts[1] + attributes + parts[3], nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"net/http"
@@ -11,6 +12,16 @@ import (
 )
 
 func main() {
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	initServices()
+
+	if err := checkFFmpeg(); err != nil {
+		log.Printf("Warning: video frames can't be extracted: %s\n", err)
+	}
+
 	// Force garbage collection
 	go func() {
 		for _ = range time.Tick(10 * time.Second) {
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	hlsURIAttributeRegexp = regexp.MustCompile(`URI="([^"]*)"`)
+	uriSchemeRegexp       = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9+.-]*):`)
+	xmlAttributeRegexp    = regexp.MustCompile(`(\s([^\s"'=<>/]+)\s*=\s*)("[^"]*"|'[^']*')`)
+)
+
+// isProxiableURI reports whether uri is relative or an http(s) URL, which can be proxied. Others,
+// like skd:// FairPlay keys and data: URIs, only mean anything as they are.
+func isProxiableURI(uri string) bool {
+	match := uriSchemeRegexp.FindStringSubmatch(uri)
+	if match == nil {
+		return true
+	}
+	scheme := strings.ToLower(match[1])
+	return scheme == "http" || scheme == "https"
+}
+
+// rewriteHLS rewrites the segment and playlist URIs of an HLS playlist, including those in the
+// URI attributes of tags such as EXT-X-KEY, EXT-X-MAP and EXT-X-MEDIA. URIs which can't be proxied
+// are left alone.
+func rewriteHLS(data []byte, baseURL *url.URL, serverURL *url.URL, _ rewriteOptions) ([]byte, error) {
+	lines := bytes.Split(data, []byte("\n"))
+
+	for i, line := range lines {
+		trimmed := string(bytes.TrimSpace(line))
+
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(trimmed, "#") {
+			if !isProxiableURI(trimmed) {
+				continue
+			}
+			newURI, err := rewriteReference(trimmed, baseURL, serverURL)
+			if err != nil {
+				return nil, err
+			}
+			lines[i] = bytes.Replace(line, []byte(trimmed), []byte(newURI), 1)
+			continue
+		}
+
+		var rewriteErr error
+		lines[i] = hlsURIAttributeRegexp.ReplaceAllFunc(line, func(attr []byte) []byte {
+			uri := string(hlsURIAttributeRegexp.FindSubmatch(attr)[1])
+			if !isProxiableURI(uri) {
+				return attr
+			}
+			newURI, err := rewriteReference(uri, baseURL, serverURL)
+			if err != nil {
+				rewriteErr = err
+				return attr
+			}
+			return []byte(`URI="` + newURI + `"`)
+		})
+		if rewriteErr != nil {
+			return nil, rewriteErr
+		}
+	}
+
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// Map from DASH element name to its attributes which hold segment URLs.
+var dashURLAttributes = map[string][]string{
+	"SegmentTemplate":     {"media", "initialization", "index"},
+	"SegmentURL":          {"media", "index"},
+	"Initialization":      {"sourceURL"},
+	"RepresentationIndex": {"sourceURL"},
+}
+
+// dashEdit replaces data[Start:End] of a manifest with Replacement.
+type dashEdit struct {
+	Start       int64
+	End         int64
+	Replacement []byte
+}
+
+// rewriteDASH rewrites the segment URLs of a DASH manifest. BaseURLs are made absolute, since
+// they're directories which can't be proxied, as are segment templates, since the player fills
+// in their $identifiers$. The rest of the manifest is left as is.
+func rewriteDASH(data []byte, baseURL *url.URL, serverURL *url.URL, _ rewriteOptions) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	// The base URL in effect inside of each open element, which BaseURL elements update
+	bases := []*url.URL{baseURL}
+	var edits []dashEdit
+	var inBaseURL bool
+
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := decoder.InputOffset()
+		base := bases[len(bases)-1]
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			bases = append(bases, base)
+			inBaseURL = t.Name.Local == "BaseURL"
+
+			tag := data[start:end]
+			rewritten := false
+			for _, attr := range t.Attr {
+				if !containsString(dashURLAttributes[t.Name.Local], attr.Name.Local) {
+					continue
+				}
+				var newURL string
+				if strings.Contains(attr.Value, "$") {
+					newURL, err = resolveReference(attr.Value, base)
+				} else {
+					newURL, err = rewriteReference(attr.Value, base, serverURL)
+				}
+				if err != nil {
+					return nil, err
+				}
+				tag = replaceXMLAttribute(tag, attr.Name.Local, newURL)
+				rewritten = true
+			}
+			if rewritten {
+				edits = append(edits, dashEdit{start, end, tag})
+			}
+		case xml.EndElement:
+			if len(bases) > 1 {
+				bases = bases[:len(bases)-1]
+			}
+			inBaseURL = false
+		case xml.CharData:
+			if !inBaseURL {
+				continue
+			}
+			ref := strings.TrimSpace(string(t))
+			if len(ref) == 0 {
+				continue
+			}
+			// BaseURL's own entry in bases is dropped at its end tag, so update its parent's
+			parent := bases[len(bases)-2]
+			resolved, err := url.Parse(ref)
+			if err != nil {
+				return nil, err
+			}
+			resolved = parent.ResolveReference(resolved)
+			bases[len(bases)-2] = resolved
+
+			var escaped bytes.Buffer
+			xml.EscapeText(&escaped, []byte(resolved.String()))
+			edits = append(edits, dashEdit{start, end, escaped.Bytes()})
+		}
+	}
+
+	// Edits were collected in document order
+	var out bytes.Buffer
+	var pos int64
+	for _, edit := range edits {
+		out.Write(data[pos:edit.Start])
+		out.Write(edit.Replacement)
+		pos = edit.End
+	}
+	out.Write(data[pos:])
+
+	return out.Bytes(), nil
+}
+
+// replaceXMLAttribute replaces the value of the attribute name in the raw start tag.
+func replaceXMLAttribute(tag []byte, name string, value string) []byte {
+	return xmlAttributeRegexp.ReplaceAllFunc(tag, func(attr []byte) []byte {
+		parts := xmlAttributeRegexp.FindSubmatch(attr)
+		if string(parts[2]) != name {
+			return attr
+		}
+
+		var buf bytes.Buffer
+		buf.Write(parts[1])
+		buf.WriteByte('"')
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteByte('"')
+		return buf.Bytes()
+	})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
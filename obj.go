@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MTL statements other than map_* whose last argument is a texture file.
+var mtlTextureStatements = map[string]bool{
+	"bump":  true,
+	"disp":  true,
+	"decal": true,
+	"refl":  true,
+	"norm":  true,
+}
+
+// Options of MTL texture statements, by the most arguments they take. Those taking more than one
+// take between one and that many numbers.
+var mtlTextureOptions = map[string]int{
+	"-blendu":  1,
+	"-blendv":  1,
+	"-bm":      1,
+	"-boost":   1,
+	"-cc":      1,
+	"-clamp":   1,
+	"-imfchan": 1,
+	"-mm":      2,
+	"-o":       3,
+	"-s":       3,
+	"-t":       3,
+	"-texres":  1,
+	"-type":    1,
+}
+
+var textFieldRegexp = regexp.MustCompile(`\S+`)
+
+// rewriteTextLines calls fn with the whitespace-separated fields of each line of data, except
+// comments, and rewrites the file name starting at the field fn returns the index of, which runs
+// to the end of the line, so it may contain spaces. Lines are otherwise kept as they are, and fn
+// returns 0 for those which don't reference a file.
+func rewriteTextLines(data []byte, baseURL *url.URL, serverURL *url.URL, fn func(fields []string) int) ([]byte, error) {
+	lines := bytes.Split(data, []byte("\n"))
+
+	for i, line := range lines {
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		index := fn(fields)
+		if index <= 0 || index >= len(fields) {
+			continue
+		}
+
+		start := textFieldRegexp.FindAllIndex(line, index+1)[index][0]
+		end := len(bytes.TrimRightFunc(line, unicode.IsSpace))
+
+		newRef, err := rewriteReference(string(line[start:end]), baseURL, serverURL)
+		if err != nil {
+			return nil, err
+		}
+
+		var newLine bytes.Buffer
+		newLine.Write(line[:start])
+		newLine.WriteString(newRef)
+		newLine.Write(line[end:])
+		lines[i] = newLine.Bytes()
+	}
+
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// rewriteOBJ rewrites the material library referenced by an OBJ model.
+func rewriteOBJ(data []byte, baseURL *url.URL, serverURL *url.URL, _ rewriteOptions) ([]byte, error) {
+	return rewriteTextLines(data, baseURL, serverURL, func(fields []string) int {
+		if fields[0] != "mtllib" {
+			return 0
+		}
+		return 1
+	})
+}
+
+// rewriteMTL rewrites the textures referenced by an MTL material library. Texture statements can
+// have options before the file name, which are skipped.
+func rewriteMTL(data []byte, baseURL *url.URL, serverURL *url.URL, _ rewriteOptions) ([]byte, error) {
+	return rewriteTextLines(data, baseURL, serverURL, func(fields []string) int {
+		statement := strings.ToLower(fields[0])
+		if !strings.HasPrefix(statement, "map_") && !mtlTextureStatements[statement] {
+			return 0
+		}
+
+		i := 1
+		for i < len(fields) {
+			maxArgs, ok := mtlTextureOptions[strings.ToLower(fields[i])]
+			if !ok {
+				break
+			}
+			i++
+			for arg := 0; arg < maxArgs && i < len(fields); arg++ {
+				if _, err := strconv.ParseFloat(fields[i], 64); arg > 0 && err != nil {
+					break
+				}
+				i++
+			}
+		}
+		return i
+	})
+}
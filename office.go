@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Map from office document MIME type to the file extension the converter expects.
+var officeMimeTypes = map[mimeType]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+}
+
+// Map from the top-level directory of an Office Open XML package to its MIME type.
+var ooxmlDirectories = map[string]mimeType{
+	"word/": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"ppt/":  "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"xl/":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Default arguments for headless LibreOffice. Each conversion gets its own user profile, since
+// concurrent soffice processes can't share one.
+const defaultOfficeConverterArgs = "-env:UserInstallation=file://{scratch}/profile --headless --convert-to pdf --outdir {outdir} {in}"
+
+// Longest "mimetype" entry read from ZIP archives; the longest office MIME type is under 80 bytes.
+const maxOfficeMimeTypeSize = 128
+
+// detectOfficeType returns the MIME type of the office document in the ZIP archive data, or an
+// empty string if it isn't one.
+func detectOfficeType(data []byte) mimeType {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return ""
+	}
+
+	for _, file := range archive.File {
+		// OpenDocument files start with an uncompressed "mimetype" entry
+		if file.Name == "mimetype" {
+			if file.Method != zip.Store || file.UncompressedSize64 > maxOfficeMimeTypeSize {
+				return ""
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return ""
+			}
+			contents, err := ioutil.ReadAll(io.LimitReader(rc, maxOfficeMimeTypeSize))
+			rc.Close()
+			if err != nil {
+				return ""
+			}
+			if _, ok := officeMimeTypes[string(contents)]; ok {
+				return string(contents)
+			}
+			return ""
+		}
+
+		for dir, t := range ooxmlDirectories {
+			if strings.HasPrefix(file.Name, dir) {
+				return t
+			}
+		}
+	}
+
+	return ""
+}
+
+func getConvertedPDFCacheKey(url string, version string) string {
+	return getIndexCacheKey(url, version, 0, "converted_pdf")
+}
+
+// readConvertedPDF returns the cached PDF conversion of the given version of the office document
+// at url, if any.
+func readConvertedPDF(url string, version string) ([]byte, bool) {
+	if farsparkCache == nil || !farsparkCache.Has(getConvertedPDFCacheKey(url, version)) {
+		return nil, false
+	}
+
+	data, err := farsparkCache.Get(getConvertedPDFCacheKey(url, version))
+	return data, err == nil
+}
+
+// convertOfficeToPDF converts an office document to PDF with the configured converter command,
+// caching the result so further pages of the same document don't need another conversion.
+func convertOfficeToPDF(data []byte, sourceType mimeType, url string) ([]byte, error) {
+	version := sourceVersion(url)
+	if pdfBytes, ok := readConvertedPDF(url, version); ok {
+		return pdfBytes, nil
+	}
+
+	if len(conf.OfficeConverterPath) == 0 {
+		return nil, errors.New("Extracting from office documents requires FARSPARK_OFFICE_CONVERTER to be set")
+	}
+
+	scratchDir, err := ioutil.TempDir("", "farspark-office")
+	if err != nil {
+		return nil, errors.New("Error creating scratch dir")
+	}
+	defer os.RemoveAll(scratchDir)
+
+	inFile := filepath.Join(scratchDir, "in"+officeMimeTypes[sourceType])
+	outDir := filepath.Join(scratchDir, "out")
+
+	if err := ioutil.WriteFile(inFile, data, 0600); err != nil {
+		return nil, errors.New("Error writing temporary office document")
+	}
+	if err := os.Mkdir(outDir, 0700); err != nil {
+		return nil, errors.New("Error creating output dir")
+	}
+
+	replacer := strings.NewReplacer("{scratch}", scratchDir, "{outdir}", outDir, "{in}", inFile)
+	args := strings.Fields(conf.OfficeConverterArgs)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+
+	if output, err := runOfficeConverter(args, filepath.Join(scratchDir, "converter.log"), time.Duration(conf.OfficeConverterTimeout)*time.Second); err != nil {
+		return nil, fmt.Errorf("Office document conversion failed: %s; %s", err, output)
+	}
+
+	pdfBytes, err := ioutil.ReadFile(filepath.Join(outDir, "in.pdf"))
+	if err != nil {
+		return nil, errors.New("Office document conversion produced no PDF")
+	}
+
+	if farsparkCache != nil {
+		farsparkCache.Put(getConvertedPDFCacheKey(url, version), pdfBytes, 0)
+	}
+
+	return pdfBytes, nil
+}
+
+// runOfficeConverter runs the converter in its own process group, and kills the whole group once
+// it exits or timeout passes, since converters like soffice start processes of their own which
+// would otherwise outlive it. Its output is written to logPath rather than a pipe, which those
+// processes could keep open, and is returned.
+func runOfficeConverter(args []string, logPath string, timeout time.Duration) ([]byte, error) {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(conf.OfficeConverterPath, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	killGroup := func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	defer killGroup()
+
+	timer := time.AfterFunc(timeout, killGroup)
+	err = cmd.Wait()
+	if !timer.Stop() {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	output, _ := ioutil.ReadFile(logPath)
+	return output, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withFakeOfficeConverter(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "farspark-fake-soffice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "soffice")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConf := conf
+	conf.OfficeConverterPath = path
+	conf.OfficeConverterArgs = "{outdir} {in}"
+
+	return func() {
+		conf = oldConf
+		os.RemoveAll(dir)
+	}
+}
+
+// isProcessRunning reports whether the process with the given pid is alive, not counting zombies.
+func isProcessRunning(pid string) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func Test_office_conversion(t *testing.T) {
+	defer withFakeOfficeConverter(t, `cp "$2" "$1/in.pdf"`)()
+	oldCache := farsparkCache
+	defer func() { farsparkCache = oldCache }()
+	farsparkCache = newMemoryCache(1 << 20)
+
+	docx := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	pdf, err := convertOfficeToPDF([]byte("%PDF-1.4"), docx, "https://example.com/a.docx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "%PDF-1.4" {
+		t.Fatalf("Expected the converted PDF, got %q", pdf)
+	}
+	if cached, ok := readConvertedPDF("https://example.com/a.docx", ""); !ok || string(cached) != "%PDF-1.4" {
+		t.Fatal("Expected the converted PDF to be cached")
+	}
+}
+
+func Test_office_conversion_timeout(t *testing.T) {
+	pidDir, err := ioutil.TempDir("", "farspark-soffice-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pidDir)
+	pidFile := filepath.Join(pidDir, "pid")
+
+	// Like soffice, start another process which would outlive the converter
+	defer withFakeOfficeConverter(t, "sleep 30 &\necho $! > "+pidFile+"\nwait")()
+	conf.OfficeConverterTimeout = 1
+
+	start := time.Now()
+	docx := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	if _, err := convertOfficeToPDF([]byte("doc"), docx, "https://example.com/b.docx"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected the conversion to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the conversion to be killed after its timeout, took %s", elapsed)
+	}
+
+	pid, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; isProcessRunning(strings.TrimSpace(string(pid))); i++ {
+		if i == 50 {
+			t.Fatal("Expected the converter's own processes to be killed too")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func Test_detect_office_type(t *testing.T) {
+	odt := "application/vnd.oasis.opendocument.text"
+	archive := func(method uint16, mimetype string) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		f, err := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(mimetype))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	if detected := detectOfficeType(archive(zip.Store, odt)); detected != odt {
+		t.Fatalf("Expected %s, got %q", odt, detected)
+	}
+	if detected := detectOfficeType(archive(zip.Deflate, odt)); detected != "" {
+		t.Fatalf("Expected a compressed mimetype entry to be ignored, got %q", detected)
+	}
+	if detected := detectOfficeType(archive(zip.Store, odt+strings.Repeat(" ", 1<<20))); detected != "" {
+		t.Fatalf("Expected an oversized mimetype entry to be ignored, got %q", detected)
+	}
+}
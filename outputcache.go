@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Header telling clients whether a response was served from the output cache.
+const cacheStatusHeader = "X-Farspark-Cache"
+
+// cachedResponse is a processed response kept in the cache, with the headers it's served with.
+type cachedResponse struct {
+	Header http.Header
+	Body   []byte
+}
+
+// getThumbnailCacheKey returns the cache key of the thumbnail described by opts, of the given
+// version of its source.
+func getThumbnailCacheKey(opts thumbnailOptions, version string) string {
+	return getIndexCacheKey(opts.SourceURL, version, 0, fmt.Sprintf("thumbnail;w=%d;h=%d;max=%d;format=%s", opts.Width, opts.Height, opts.MaxDimension, opts.Format))
+}
+
+// getRawCacheKey returns the cache key of the raw response for the given version of url,
+// rewritten according to opts.
+func getRawCacheKey(url string, version string, opts rewriteOptions) string {
+	return getIndexCacheKey(url, version, 0, fmt.Sprintf("raw;%+v", opts))
+}
+
+// isRawCacheable reports whether raw responses of contentType may be kept in the output cache.
+func isRawCacheable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "model/gltf+json" || mediaType == "model/gltf-binary"
+}
+
+// Cached responses are stored as the length of their JSON-encoded headers, the headers and then
+// the body.
+func encodeCachedResponse(response cachedResponse) ([]byte, error) {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 4, 4+len(header)+len(response.Body))
+	binary.BigEndian.PutUint32(data, uint32(len(header)))
+	data = append(data, header...)
+	return append(data, response.Body...), nil
+}
+
+func decodeCachedResponse(data []byte) (cachedResponse, error) {
+	var response cachedResponse
+	if len(data) < 4 || int64(binary.BigEndian.Uint32(data)) > int64(len(data)-4) {
+		return response, errInvalidCacheEntry
+	}
+	headerEnd := 4 + int(binary.BigEndian.Uint32(data))
+	if err := json.Unmarshal(data[4:headerEnd], &response.Header); err != nil {
+		return response, err
+	}
+	response.Body = data[headerEnd:]
+	return response, nil
+}
+
+func readCachedResponse(key string) (cachedResponse, bool) {
+	if farsparkCache == nil {
+		return cachedResponse{}, false
+	}
+	data, err := farsparkCache.Get(key)
+	if err != nil {
+		return cachedResponse{}, false
+	}
+	response, err := decodeCachedResponse(data)
+	return response, err == nil
+}
+
+// writeCachedResponse keeps a response in the cache for ttl, or until its source changes if ttl
+// is 0.
+func writeCachedResponse(key string, response cachedResponse, ttl time.Duration) {
+	if data, err := encodeCachedResponse(response); err == nil {
+		farsparkCache.Put(key, data, ttl)
+	}
+}
+
+// rawCacheTTL returns how long a raw response may be cached for, given the origin's headers, or 0
+// if it mustn't be. Rewritten responses are cached for at most half the time the subresource URLs
+// in them are valid for, so they're always served with at least half of it left.
+func rawCacheTTL(header http.Header, rewritten bool) time.Duration {
+	var info sourceInfo
+	if !info.update(header) {
+		return 0
+	}
+
+	ttl := time.Until(info.FreshUntil)
+	if maxTTL := time.Duration(conf.SubresourceURLTTL) * time.Second / 2; rewritten && maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl < time.Second {
+		return 0
+	}
+	return ttl
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_cached_response_encoding(t *testing.T) {
+	response := cachedResponse{http.Header{"Content-Type": {"image/png"}}, []byte("body")}
+	data, err := encodeCachedResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeCachedResponse(data)
+	if err != nil || !reflect.DeepEqual(decoded, response) {
+		t.Fatalf("Expected %+v, got %+v, %v", response, decoded, err)
+	}
+
+	if _, err := decodeCachedResponse([]byte{0, 0, 1, 0, '{'}); err == nil {
+		t.Fatal("Expected truncated response to be rejected")
+	}
+}
+
+func Test_thumbnail_cache_key(t *testing.T) {
+	opts := thumbnailOptions{SourceURL: "https://example.com/image.png", Width: 100, Height: 100}
+	key := getThumbnailCacheKey(opts, "")
+
+	opts.Signature, opts.Expires = "signature", 123
+	if getThumbnailCacheKey(opts, "") != key {
+		t.Fatal("Expected signatures not to affect the key")
+	}
+	opts.Format = "image/webp"
+	if getThumbnailCacheKey(opts, "") == key {
+		t.Fatal("Expected the format to affect the key")
+	}
+}
+
+func Test_raw_cache_TTL(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf.SubresourceURLTTL = 600
+
+	if ttl := rawCacheTTL(http.Header{"Cache-Control": {"max-age=3600"}}, false); ttl < 3590*time.Second || ttl > time.Hour {
+		t.Errorf("Expected the origin's max age, got %s", ttl)
+	}
+	if ttl := rawCacheTTL(http.Header{"Cache-Control": {"max-age=3600"}}, true); ttl != 300*time.Second {
+		t.Errorf("Expected rewritten responses to be cached for half the subresource URL TTL, got %s", ttl)
+	}
+	if ttl := rawCacheTTL(http.Header{"Cache-Control": {"no-store, max-age=3600"}}, false); ttl != 0 {
+		t.Errorf("Expected no-store responses not to be cached, got %s", ttl)
+	}
+}
+
+func Test_raw_cache(t *testing.T) {
+	defer allowLoopback()()
+	conf.RawCacheMaxSize = 1024
+	conf.ServerURL = nil
+	oldCache := farsparkCache
+	farsparkCache = newMemoryCache(1 << 20)
+	defer func() { farsparkCache = oldCache }()
+
+	var requests int
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Set-Cookie", "session=secret")
+		rw.Header().Set("Set-Cookie2", "session=secret")
+		rw.Write([]byte("not really a png"))
+	}))
+	defer origin.Close()
+
+	path := "/0/raw/0/0/0/0/" + base64.RawURLEncoding.EncodeToString([]byte(origin.URL+"/image.png"))
+	handler := newHTTPHandler()
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rw.Code != 200 || rw.Body.String() != "not really a png" || rw.Header().Get(cacheStatusHeader) != expected {
+			t.Fatalf("Expected a %s, got %d %q with %s", expected, rw.Code, rw.Body.String(), rw.Header().Get(cacheStatusHeader))
+		}
+		if rw.Header().Get("Content-Type") != "image/png" || rw.Header().Get("Content-Length") != "16" {
+			t.Fatalf("Unexpected headers %v", rw.Header())
+		}
+		if _, ok := rw.Header()["Set-Cookie"]; ok || len(rw.Header().Get("Set-Cookie2")) > 0 {
+			t.Fatalf("Expected the origin's cookies not to be passed on, got %v", rw.Header())
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("Expected one request to the origin, got %d", requests)
+	}
+}
+
+func Test_raw_cache_rewritten_cache_control(t *testing.T) {
+	defer allowLoopback()()
+	conf.RawCacheMaxSize = 1024
+	conf.SubresourceURLTTL = 600
+	conf.ServerURL, _ = url.Parse("http://localhost:8080")
+	oldCache := farsparkCache
+	farsparkCache = newMemoryCache(1 << 20)
+	defer func() { farsparkCache = oldCache }()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "model/gltf+json")
+		rw.Header().Set("Cache-Control", "public, max-age=86400")
+		rw.Header().Set("Expires", time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat))
+		rw.Write([]byte(`{"asset":{"version":"2.0"},"images":[{"uri":"a.png"}]}`))
+	}))
+	defer origin.Close()
+
+	path := "/0/raw/0/0/0/0/" + base64.RawURLEncoding.EncodeToString([]byte(origin.URL+"/model.gltf"))
+	handler := newHTTPHandler()
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rw.Code != 200 || rw.Header().Get(cacheStatusHeader) != expected {
+			t.Fatalf("Expected a %s, got %d with %s", expected, rw.Code, rw.Header().Get(cacheStatusHeader))
+		}
+		if cacheControl := rw.Header().Get("Cache-Control"); cacheControl != "public, max-age=300" || len(rw.Header().Get("Expires")) > 0 {
+			t.Fatalf("Expected the %s to be cached for at most half the subresource URL TTL, got %v", expected, rw.Header())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+var (
+	pdfPrerenderMutex sync.Mutex
+	pdfPrerenderJobs  = make(map[string]bool) // PDFs being pre-rendered, by prerender key
+	pdfPrerenderSlots chan struct{}
+)
+
+func initPDFPrerendering() {
+	pdfPrerenderSlots = make(chan struct{}, conf.PDFPrerenderConcurrency)
+}
+
+// getPrerenderKey identifies pre-rendering the pages of the given version of the source at url
+// according to opts.
+func getPrerenderKey(url string, version string, opts extractOptions) string {
+	return getIndexCacheKey(url, version, 0, "prerender"+opts.cacheVariant())
+}
+
+// prerenderPDFPages starts rendering the pages of the PDF in data which follow the one at index in
+// the background, caching them like extractPDFPage does, so paging through a document doesn't
+// wait on each page. It's disabled unless conf.PDFPrerenderConcurrency is set, and PDFs with more
+// than conf.PDFPrerenderPages pages aren't pre-rendered at all. Pages are only rendered while no
+// request is waiting for a renderer. Nothing is started if the PDF is already being pre-rendered,
+// or if conf.PDFPrerenderConcurrency PDFs are.
+func prerenderPDFPages(data []byte, url string, index int, opts extractOptions) {
+	if farsparkCache == nil || conf.PDFPrerenderConcurrency <= 0 {
+		return
+	}
+
+	version := sourceVersion(url)
+	key := getPrerenderKey(url, version, opts)
+
+	pdfPrerenderMutex.Lock()
+	defer pdfPrerenderMutex.Unlock()
+
+	if pdfPrerenderJobs[key] {
+		return
+	}
+	select {
+	case pdfPrerenderSlots <- struct{}{}:
+	default:
+		return
+	}
+	pdfPrerenderJobs[key] = true
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Pre-rendering %s panicked: %v\n", url, r)
+			}
+
+			pdfPrerenderMutex.Lock()
+			delete(pdfPrerenderJobs, key)
+			pdfPrerenderMutex.Unlock()
+			<-pdfPrerenderSlots
+		}()
+
+		if err := prerenderPDF(data, url, version, index, opts); err != nil {
+			log.Printf("Error pre-rendering %s: %s\n", url, err)
+		}
+	}()
+}
+
+func prerenderPDF(data []byte, url string, version string, index int, opts extractOptions) error {
+	stats, _ := statsd.New()
+
+	scratchDir, err := ioutil.TempDir("", "farspark-prerender")
+	if err != nil {
+		return errors.New("Error creating scratch dir")
+	}
+	defer os.RemoveAll(scratchDir)
+
+	inFile := fmt.Sprintf("%s/in.pdf", scratchDir)
+	outFile := fmt.Sprintf("%s/out", scratchDir)
+
+	if err := ioutil.WriteFile(inFile, data, 0600); err != nil {
+		return errors.New("Error writing temporary PDF file")
+	}
+
+	pdfInst, numPages, err := openPDF(inFile)
+	if err != nil {
+		return err
+	}
+
+	if numPages > conf.PDFPrerenderPages {
+		stats.Increment("farspark.pdf_prerender_skipped")
+		return nil
+	}
+
+	maxIndex := numPages - 1
+	queueTimeout := time.Duration(conf.WriteTimeout) * time.Second
+	renderTimeout := time.Duration(conf.PDFRenderTimeout) * time.Second
+
+	for page := index + 1; page <= maxIndex; page++ {
+		if farsparkCache.Has(getIndexContentsCacheKey(url, version, page, opts.cacheVariant())) {
+			continue
+		}
+
+		outBytes, err := renderPDFPage(pdfInst, inFile, outFile, page, opts, func(args []string) error {
+			return pdfRenderers.RenderIdle(args, queueTimeout, renderTimeout)
+		})
+		if err != nil {
+			return err
+		}
+
+		// Pages of an outdated version mustn't be cached under the keys of a newer one
+		if sourceVersion(url) != version {
+			return nil
+		}
+
+		cachePDFPage(url, version, page, maxIndex, opts, outBytes)
+		stats.Increment("farspark.pdf_prerendered_pages")
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// prerenderTestPDF pre-renders the pages of testdata/in1.pdf after the first with a fake
+// Ghostscript, and returns what was cached for each of its 9 pages.
+func prerenderTestPDF(t *testing.T, maxPages int) []string {
+	defer withFakeGhostscript(t, `for arg in "$@"; do
+	case "$arg" in
+		-sOutputFile=*) out="${arg#-sOutputFile=}" ;;
+		-dFirstPage=*) page="${arg#-dFirstPage=}" ;;
+	esac
+done
+echo "page $page" > "$out"`)()
+
+	oldConf, oldCache := conf, farsparkCache
+	defer func() {
+		conf, farsparkCache = oldConf, oldCache
+		initPDFPrerendering()
+	}()
+	conf.PDFPrerenderPages = maxPages
+	conf.PDFPrerenderConcurrency = 1
+	initPDFPrerendering()
+	farsparkCache = newMemoryCache(1 << 20)
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dataDir, "in1.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	prerenderPDFPages(data, "dummy", 0, opts)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pdfPrerenderMutex.Lock()
+		running := pdfPrerenderJobs[getPrerenderKey("dummy", "", opts)]
+		pdfPrerenderMutex.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Pre-rendering didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pages := make([]string, 9)
+	for page := range pages {
+		data, _ := farsparkCache.Get(getIndexContentsCacheKey("dummy", "", page, opts.cacheVariant()))
+		pages[page] = string(data)
+	}
+	return pages
+}
+
+func Test_PDF_prerender(t *testing.T) {
+	pages := prerenderTestPDF(t, 9)
+	if pages[0] != "" {
+		t.Error("Expected the requested page not to be pre-rendered")
+	}
+	for page := 1; page < len(pages); page++ {
+		if expected := fmt.Sprintf("page %d\n", page+1); pages[page] != expected {
+			t.Errorf("Expected page %d to be %q, got %q", page, expected, pages[page])
+		}
+	}
+}
+
+func Test_PDF_prerender_too_many_pages(t *testing.T) {
+	for page, data := range prerenderTestPDF(t, 8) {
+		if data != "" {
+			t.Errorf("Expected no pages of a PDF over the page limit to be pre-rendered, got page %d", page)
+		}
+	}
+}
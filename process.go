@@ -3,17 +3,16 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/gfodor/go-ghostscript/ghostscript"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/url"
 	"os"
 	"rsc.io/pdf"
 	"strconv"
-	"sync"
+	"time"
 )
 
 // Map from output MIME type to Ghostscript output device identifier.
@@ -22,164 +21,262 @@ var outputFileDevices = map[mimeType]string{
 	"image/png":  "png16m",
 }
 
-var gsMutex = &sync.Mutex{}
-var gs *ghostscript.Ghostscript = nil
-
-func getIndexCacheKey(url string, index int, suffix string) string {
+// getIndexCacheKey returns the cache key of something derived from the given version of the
+// source at url, as returned by sourceVersion, so it changes along with the source.
+func getIndexCacheKey(url string, version string, index int, suffix string) string {
 	sha256 := sha256.New()
 	sha256.Write([]byte(url))
+	sha256.Write([]byte(version))
 	sha256.Write([]byte(fmt.Sprintf("%d", index)))
 	sha256.Write([]byte(suffix))
-	return base64.URLEncoding.EncodeToString(sha256.Sum(nil))
+	return getSourceKeyPrefix(url) + base64.URLEncoding.EncodeToString(sha256.Sum(nil))
 }
 
-func getIndexContentsCacheKey(url string, index int) string {
-	return getIndexCacheKey(url, index, "contents")
+// getIndexContentsCacheKey returns the cache key of the contents at index, rendered according to
+// variant, which is empty for the default rendering.
+func getIndexContentsCacheKey(url string, version string, index int, variant string) string {
+	return getIndexCacheKey(url, version, index, "contents"+variant)
 }
 
-func getMaxIndexCacheKey(url string) string {
-	return getIndexCacheKey(url, 0, "max_index")
+// cacheVariant identifies renderings other than the default PNG in cache keys.
+func (o extractOptions) cacheVariant() string {
+	variant := ""
+	if o.Format != "image/png" {
+		variant += ";" + o.Format
+	}
+	if o.Timestamp >= 0 {
+		variant += ";t=" + strconv.FormatFloat(o.Timestamp, 'f', -1, 64)
+	}
+	if o.DPI > 0 {
+		variant += fmt.Sprintf(";dpi=%d", o.DPI)
+	}
+	if o.Width > 0 {
+		variant += fmt.Sprintf(";w=%d", o.Width)
+	}
+	if o.Quality > 0 {
+		variant += fmt.Sprintf(";q=%d", o.Quality)
+	}
+	return variant
 }
 
-func extractPDFPage(data []byte, url string, index int, outputFormat mimeType) ([]byte, int, error) {
-	scratchDir, err := ioutil.TempDir("", "farspark-scratch")
+func getMaxIndexCacheKey(url string, version string) string {
+	return getIndexCacheKey(url, version, 0, "max_index")
+}
 
-	if err != nil {
-		return nil, 0, errors.New("Error creating scratch dir")
+// Resolution PDF pages are rendered at unless a DPI or target width is requested.
+const defaultPDFResolution = 144
+
+func findInheritedPageValue(page pdf.Page, key string) pdf.Value {
+	for v := page.V; !v.IsNull(); v = v.Key("Parent") {
+		if r := v.Key(key); !r.IsNull() {
+			return r
+		}
 	}
+	return pdf.Value{}
+}
 
-	defer os.RemoveAll(scratchDir)
+// openPDF opens the PDF in inFile and returns it along with its number of pages. rsc.io/pdf
+// panics on some malformed PDFs rather than returning an error, so such panics are returned as
+// errors.
+func openPDF(inFile string) (pdfInst *pdf.Reader, numPages int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pdfInst, numPages, err = nil, 0, fmt.Errorf("Invalid PDF: %v", r)
+		}
+	}()
 
-	inFile := fmt.Sprintf("%s/in.pdf", scratchDir)
-	outFile := fmt.Sprintf("%s/out", scratchDir)
+	if pdfInst, err = pdf.Open(inFile); err != nil {
+		return nil, 0, err
+	}
+	return pdfInst, pdfInst.NumPage(), nil
+}
 
-	log.Printf("Preparing to extract page from %s into %s\n", inFile, outFile)
+// getPDFPageSize returns the size of the page at index in points, taking its rotation into
+// account. Like openPDF, it returns an error rather than panicking on malformed PDFs.
+func getPDFPageSize(pdfInst *pdf.Reader, index int) (width float64, height float64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			width, height, err = 0, 0, fmt.Errorf("Invalid PDF: %v", r)
+		}
+	}()
 
-	if err := ioutil.WriteFile(inFile, data, 0600); err != nil {
-		return nil, 0, errors.New("Error writing temporary PDF file")
+	page := pdfInst.Page(index + 1)
+	box := findInheritedPageValue(page, "MediaBox")
+	if box.Len() != 4 {
+		// Ghostscript's default page size, US Letter
+		return 612, 792, nil
 	}
 
-	gsMutex.Lock()
+	width = math.Abs(box.Index(2).Float64() - box.Index(0).Float64())
+	height = math.Abs(box.Index(3).Float64() - box.Index(1).Float64())
+
+	if findInheritedPageValue(page, "Rotate").Int64()%180 != 0 {
+		width, height = height, width
+	}
 
-	if gs == nil {
-		_, err = ghostscript.GetRevision()
+	return width, height, nil
+}
 
-		if err != nil {
-			gsMutex.Unlock()
-			return nil, 0, err
-		}
+// getPDFRenderArgs returns the Ghostscript arguments which render a page of the given size
+// according to opts, keeping the output within conf.MaxDimension.
+func getPDFRenderArgs(opts extractOptions, pageWidth float64, pageHeight float64) []string {
+	maxDimension := float64(conf.MaxDimension)
 
-		gsPtr, err := ghostscript.NewInstance()
-		if err != nil {
-			gsMutex.Unlock()
-			return nil, 0, err
+	if opts.Width > 0 && pageWidth > 0 && pageHeight > 0 {
+		width := float64(opts.Width)
+		height := math.Floor(width*pageHeight/pageWidth + 0.5)
+
+		if height > maxDimension {
+			height = maxDimension
+			width = math.Floor(maxDimension*pageWidth/pageHeight + 0.5)
 		}
 
-		gs = gsPtr
+		return []string{fmt.Sprintf("-g%dx%d", int(math.Max(width, 1)), int(math.Max(height, 1))), "-dPDFFitPage"}
 	}
 
-	args := []string{
-		"gs",
-		fmt.Sprintf("-sDEVICE=%s", outputFileDevices[outputFormat]),
-		fmt.Sprintf("-sOutputFile=%s", outFile),
-		fmt.Sprintf("-dFirstPage=%d", index+1),
-		fmt.Sprintf("-dLastPage=%d", index+1),
-		"-dNOPAUSE",
-		"-r144",
-		inFile,
+	resolution := float64(defaultPDFResolution)
+	if opts.DPI > 0 {
+		resolution = float64(opts.DPI)
 	}
 
-	if err := gs.Init(args); err != nil {
-		gsMutex.Unlock()
-
-		return nil, 0, err
+	if pageWidth > 0 && pageHeight > 0 {
+		resolution = math.Min(resolution, math.Floor(math.Min(maxDimension*72/pageWidth, maxDimension*72/pageHeight)))
 	}
 
-	gs.Exit()
-	gsMutex.Unlock()
+	return []string{fmt.Sprintf("-r%d", int(math.Max(resolution, 1)))}
+}
+
+func extractPDFPage(data []byte, url string, index int, opts extractOptions) ([]byte, int, error) {
+	scratchDir, err := ioutil.TempDir("", "farspark-scratch")
 
-	pdfInst, _ := pdf.Open(inFile)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, errors.New("Error creating scratch dir")
 	}
 
-	maxIndex := pdfInst.NumPage() - 1
+	defer os.RemoveAll(scratchDir)
+
+	inFile := fmt.Sprintf("%s/in.pdf", scratchDir)
+	outFile := fmt.Sprintf("%s/out", scratchDir)
+
+	log.Printf("Preparing to extract page from %s into %s\n", inFile, outFile)
 
-	outFilePtr, err := os.Open(outFile)
-	defer outFilePtr.Close()
+	if err := ioutil.WriteFile(inFile, data, 0600); err != nil {
+		return nil, 0, errors.New("Error writing temporary PDF file")
+	}
 
+	pdfInst, numPages, err := openPDF(inFile)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	outBytes, err := ioutil.ReadAll(outFilePtr)
+	maxIndex := numPages - 1
+	if index > maxIndex {
+		return nil, 0, errIndexOutOfRange
+	}
+
+	queueTimeout := time.Duration(conf.WriteTimeout) * time.Second
+	renderTimeout := time.Duration(conf.PDFRenderTimeout) * time.Second
 
-	if err == nil && farsparkCache != nil {
-		contentsCacheKey := getIndexContentsCacheKey(url, index)
-		maxIndexCacheKey := getMaxIndexCacheKey(url)
+	outBytes, err := renderPDFPage(pdfInst, inFile, outFile, index, opts, func(args []string) error {
+		return pdfRenderers.Render(args, queueTimeout, renderTimeout)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
 
-		farsparkCache.Write(contentsCacheKey, outBytes)
-		farsparkCache.Write(maxIndexCacheKey, []byte(strconv.Itoa(maxIndex)))
+	if farsparkCache != nil {
+		cachePDFPage(url, sourceVersion(url), index, maxIndex, opts, outBytes)
 	}
 
-	return outBytes, maxIndex, err
+	return outBytes, maxIndex, nil
 }
 
-func generateFarsparkURL(targetURL *url.URL, serverURL *url.URL) (*url.URL, error) {
-	path, err := url.Parse("/0/raw/0/0/0/0/" + base64.RawURLEncoding.EncodeToString([]byte(targetURL.String())))
+// renderPDFPage renders the page at index of the PDF in inFile, opened as pdfInst, according to
+// opts, running Ghostscript with render.
+func renderPDFPage(pdfInst *pdf.Reader, inFile string, outFile string, index int, opts extractOptions, render func(args []string) error) ([]byte, error) {
+	pageWidth, pageHeight, err := getPDFPageSize(pdfInst, index)
 	if err != nil {
 		return nil, err
 	}
-	return serverURL.ResolveReference(path), nil
-}
 
-func transformSubresourceURL(subresourceURL *url.URL, baseURL *url.URL, serverURL *url.URL) (*url.URL, error) {
-	targetURL := baseURL.ResolveReference(subresourceURL)
-	return generateFarsparkURL(targetURL, serverURL)
-}
+	// Ghostscript has no WebP device, so those are rendered as PNG and transcoded
+	renderFormat := opts.Format
+	if _, ok := outputFileDevices[renderFormat]; !ok {
+		renderFormat = "image/png"
+	}
+
+	args := []string{
+		"-q",
+		"-dSAFER",
+		"-dBATCH",
+		"-dNOPAUSE",
+		fmt.Sprintf("-sDEVICE=%s", outputFileDevices[renderFormat]),
+		fmt.Sprintf("-sOutputFile=%s", outFile),
+		fmt.Sprintf("-dFirstPage=%d", index+1),
+		fmt.Sprintf("-dLastPage=%d", index+1),
+	}
+	args = append(args, getPDFRenderArgs(opts, pageWidth, pageHeight)...)
+	if renderFormat == "image/jpeg" {
+		args = append(args, fmt.Sprintf("-dJPEGQ=%d", opts.quality()))
+	}
+	args = append(args, inFile)
 
-func processGLTF(data []byte, baseURL *url.URL, serverURL *url.URL) ([]byte, error) {
-	var model map[string]interface{}
-	err := json.Unmarshal(data, &model)
+	if err := render(args); err != nil {
+		return nil, err
+	}
+
+	outBytes, err := ioutil.ReadFile(outFile)
 	if err != nil {
 		return nil, err
 	}
 
-	switch images := model["images"].(type) {
-	case []interface{}:
-		for _, v := range images {
-			image := v.(map[string]interface{})
-			oldURL, err := url.Parse(image["uri"].(string))
-			if err != nil {
-				return nil, err
-			}
-			newURL, err := transformSubresourceURL(oldURL, baseURL, serverURL)
-			if err != nil {
-				return nil, err
-			}
-			image["uri"] = newURL.String()
+	if renderFormat != opts.Format {
+		if outBytes, err = transcodeImage(outBytes, opts.Format, opts.quality()); err != nil {
+			return nil, err
 		}
 	}
 
-	switch buffers := model["buffers"].(type) {
-	case []interface{}:
-		for _, v := range buffers {
-			buffer := v.(map[string]interface{})
-			oldURL, err := url.Parse(buffer["uri"].(string))
-			if err != nil {
-				return nil, err
-			}
-			newURL, err := transformSubresourceURL(oldURL, baseURL, serverURL)
-			if err != nil {
-				return nil, err
-			}
-			buffer["uri"] = newURL.String()
+	return outBytes, nil
+}
+
+func cachePDFPage(url string, version string, index int, maxIndex int, opts extractOptions, data []byte) {
+	contentsCacheKey := getIndexContentsCacheKey(url, version, index, opts.cacheVariant())
+	maxIndexCacheKey := getMaxIndexCacheKey(url, version)
+
+	farsparkCache.Put(contentsCacheKey, data, 0)
+	farsparkCache.Put(maxIndexCacheKey, []byte(strconv.Itoa(maxIndex)), 0)
+}
+
+// generateFarsparkURL returns a raw URL for targetURL on serverURL. When keys are configured, it's
+// signed with the first one, and expires after conf.SubresourceURLTTL seconds if that's set.
+func generateFarsparkURL(targetURL *url.URL, serverURL *url.URL) (*url.URL, error) {
+	path := "/raw/0/0/0/0/" + base64.RawURLEncoding.EncodeToString([]byte(targetURL.String()))
+
+	signature := "0"
+	query := make(url.Values)
+	if len(conf.Keys) > 0 {
+		if conf.SubresourceURLTTL > 0 {
+			query.Set("exp", strconv.FormatInt(time.Now().Unix()+int64(conf.SubresourceURLTTL), 10))
 		}
+		signature = signMessage(legacySignatureMessage(path, query))
 	}
 
-	result, err := json.Marshal(model)
+	farsparkURL, err := url.Parse("/" + signature + path)
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	farsparkURL.RawQuery = query.Encode()
+	return serverURL.ResolveReference(farsparkURL), nil
+}
+
+func transformSubresourceURL(subresourceURL *url.URL, baseURL *url.URL, serverURL *url.URL) (*url.URL, error) {
+	targetURL := baseURL.ResolveReference(subresourceURL)
+
+	// Documents referencing sources we aren't allowed to fetch are refused rather than left
+	// pointing clients at them
+	if !isAllowedSource(targetURL) {
+		return nil, sourceNotAllowedErr
+	}
+
+	return generateFarsparkURL(targetURL, serverURL)
 }
@@ -3,14 +3,26 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"rsc.io/pdf"
+	"strings"
 	"testing"
 	"time"
 )
 
 const dataDir = "testdata"
 
+func TestMain(m *testing.M) {
+	initServices()
+	os.Exit(m.Run())
+}
+
 func loadTestData(t *testing.T, inFile string, outFile string) ([]byte, []byte) {
 	in, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dataDir, inFile))
 	if err != nil {
@@ -36,9 +48,80 @@ func Test_thumbnail(t *testing.T) {
 	}
 }
 
+func Test_scale_within(t *testing.T) {
+	cases := [][4]int{
+		{4096, 2048, 1024, 512},
+		{2048, 4096, 512, 1024},
+		{1000, 800, 1000, 800},
+		{4096, 1, 1024, 1},
+	}
+
+	for _, c := range cases {
+		width, height := scaleWithin(c[0], c[1], 1024)
+		if width != c[2] || height != c[3] {
+			t.Fatalf("Expected %dx%d to be scaled to %dx%d, got %dx%d", c[0], c[1], c[2], c[3], width, height)
+		}
+	}
+}
+
+func Test_downscale_large_image(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf.MaxDimension = 100
+
+	src := image.NewRGBA(image.Rect(0, 0, 300, 150))
+	encoders := map[string]func(io.Writer, image.Image) error{
+		"PNG":  png.Encode,
+		"JPEG": func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) },
+	}
+
+	for name, encode := range encoders {
+		var in bytes.Buffer
+		if err := encode(&in, src); err != nil {
+			t.Fatal(err)
+		}
+
+		timer := startTimer(time.Duration(1)*time.Second, "Processing")
+		result, err := downscaleImage(in.Bytes(), "image/png", 50, timer)
+		if err != nil {
+			t.Fatalf("Expected the %s to be scaled down, got %v", name, err)
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(result))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 50 || config.Height != 25 {
+			t.Fatalf("Expected the %s to be scaled down to 50x25, got %dx%d", name, config.Width, config.Height)
+		}
+
+		conf.MaxResolution = 300*150 - 1
+		if _, err := downscaleImage(in.Bytes(), "image/png", 50, timer); err == nil {
+			t.Fatalf("Expected a %s over the max resolution to be rejected", name)
+		}
+		conf.MaxResolution = oldConf.MaxResolution
+	}
+}
+
+func Test_scale_large_image(t *testing.T) {
+	var in bytes.Buffer
+	png.Encode(&in, image.NewRGBA(image.Rect(0, 0, 1024, 512)))
+
+	result, err := scaleLargeImage(in.Bytes(), 256, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 256 || config.Height != 128 {
+		t.Fatalf("Expected the image to be scaled to 256x128, got %dx%d", config.Width, config.Height)
+	}
+}
+
 func Test_PDF_PNG(t *testing.T) {
 	in, out := loadTestData(t, "in1.pdf", "out1.png")
-	result, _, err := extractPDFPage(in, "dummy", 3, "image/png")
+	result, _, err := extractPDFPage(in, "dummy", 3, extractOptions{Format: "image/png", Timestamp: -1})
 
 	if err != nil {
 		t.Fatal(err)
@@ -58,7 +141,7 @@ func Test_GLTF_GLTF_rewrite(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, err := processGLTF(in, baseURL, serverURL)
+	result, err := processGLTF(in, baseURL, serverURL, rewriteOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,7 +160,7 @@ func Test_GLTF_GLTF_no_images(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	result, err := processGLTF(in, baseURL, serverURL)
+	result, err := processGLTF(in, baseURL, serverURL, rewriteOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,3 +168,57 @@ func Test_GLTF_GLTF_no_images(t *testing.T) {
 		t.Fatal("Unexpected output.")
 	}
 }
+
+func Test_PDF_page_size(t *testing.T) {
+	pdfInst, err := pdf.Open(fmt.Sprintf("%s/%s", dataDir, "in1.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, height, err := getPDFPageSize(pdfInst, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width <= 0 || height <= 0 {
+		t.Fatalf("Unexpected page size %gx%g", width, height)
+	}
+}
+
+func Test_malformed_PDF(t *testing.T) {
+	// The xref table points the catalog at the page tree's object, which rsc.io/pdf panics on
+	malformed := "%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Count 1 /Kids [] >>\nendobj\n" +
+		"xref\n0 3\n0000000000 65535 f \n0000000058 00000 n \n0000000058 00000 n \n" +
+		"trailer\n<< /Size 3 /Root 1 0 R >>\nstartxref\n110\n%%EOF\n"
+
+	inFile, err := ioutil.TempFile("", "farspark-malformed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(inFile.Name())
+	inFile.WriteString(malformed)
+	inFile.Close()
+
+	if _, _, err := openPDF(inFile.Name()); err == nil || !strings.HasPrefix(err.Error(), "Invalid PDF") {
+		t.Fatalf("Expected the malformed PDF to be rejected, got %v", err)
+	}
+}
+
+func Test_PDF_render_args(t *testing.T) {
+	cases := []struct {
+		opts     extractOptions
+		expected string
+	}{
+		{extractOptions{}, "-r144"},
+		{extractOptions{DPI: 72}, "-r72"},
+		{extractOptions{DPI: 600}, "-r186"},
+		{extractOptions{Width: 306}, "-g306x396 -dPDFFitPage"},
+		{extractOptions{Width: 2048}, "-g1583x2048 -dPDFFitPage"},
+	}
+
+	for _, c := range cases {
+		args := strings.Join(getPDFRenderArgs(c.opts, 612, 792), " ")
+		if args != c.expected {
+			t.Errorf("Expected %s for %+v, got %s", c.expected, c.opts, args)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+var errRendererQueueTimeout = errors.New("Timed out waiting for a free PDF renderer")
+
+// rendererPool runs Ghostscript renders as separate processes, at most as many at a time as it
+// has slots, so one slow or runaway PDF can't hold up the others or the server itself.
+type rendererPool struct {
+	slots  chan struct{}
+	queued int64
+	active int64
+	stats  *statsd.Client
+}
+
+var pdfRenderers *rendererPool
+
+func newRendererPool(concurrency int) *rendererPool {
+	stats, _ := statsd.New()
+
+	return &rendererPool{
+		slots: make(chan struct{}, concurrency),
+		stats: stats,
+	}
+}
+
+func initPDFRenderers() {
+	pdfRenderers = newRendererPool(conf.PDFConcurrency)
+}
+
+func (p *rendererPool) reportDepth() {
+	p.stats.Gauge("farspark.pdf_render_queued", atomic.LoadInt64(&p.queued))
+	p.stats.Gauge("farspark.pdf_render_active", atomic.LoadInt64(&p.active))
+}
+
+// Render runs Ghostscript with args once a slot is free, waiting at most queueTimeout for one,
+// and kills it if it takes longer than renderTimeout.
+func (p *rendererPool) Render(args []string, queueTimeout time.Duration, renderTimeout time.Duration) error {
+	atomic.AddInt64(&p.queued, 1)
+	p.reportDepth()
+
+	select {
+	case p.slots <- struct{}{}:
+		atomic.AddInt64(&p.queued, -1)
+	case <-time.After(queueTimeout):
+		atomic.AddInt64(&p.queued, -1)
+		p.reportDepth()
+		p.stats.Increment("farspark.pdf_render_queue_timeouts")
+		return errRendererQueueTimeout
+	}
+
+	return p.run(args, renderTimeout)
+}
+
+// Interval at which RenderIdle checks whether the pool is idle.
+const idleRenderPollInterval = 50 * time.Millisecond
+
+// RenderIdle runs Ghostscript with args like Render, but only takes a slot while no other render
+// is waiting for one, so renders nobody is waiting for yet never hold up ones somebody is. It
+// gives up if the pool doesn't go idle within queueTimeout.
+func (p *rendererPool) RenderIdle(args []string, queueTimeout time.Duration, renderTimeout time.Duration) error {
+	deadline := time.Now().Add(queueTimeout)
+	for {
+		if atomic.LoadInt64(&p.queued) == 0 {
+			select {
+			case p.slots <- struct{}{}:
+				return p.run(args, renderTimeout)
+			default:
+			}
+		}
+		if time.Now().After(deadline) {
+			p.stats.Increment("farspark.pdf_idle_render_queue_timeouts")
+			return errRendererQueueTimeout
+		}
+		time.Sleep(idleRenderPollInterval)
+	}
+}
+
+// run runs Ghostscript with args in a slot which has already been taken, and frees it afterwards.
+func (p *rendererPool) run(args []string, renderTimeout time.Duration) error {
+	atomic.AddInt64(&p.active, 1)
+	p.reportDepth()
+
+	defer func() {
+		<-p.slots
+		atomic.AddInt64(&p.active, -1)
+		p.reportDepth()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, conf.GhostscriptPath, args...).CombinedOutput()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		p.stats.Increment("farspark.pdf_render_timeouts")
+		return fmt.Errorf("PDF render killed after %s", renderTimeout)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Ghostscript failed: %s; %s", err, output)
+	}
+
+	return nil
+}
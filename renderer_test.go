@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withFakeGhostscript points conf.GhostscriptPath at a shell script for the duration of a test.
+func withFakeGhostscript(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "farspark-fake-gs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "gs")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := conf.GhostscriptPath
+	conf.GhostscriptPath = path
+
+	return func() {
+		conf.GhostscriptPath = oldPath
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_renderer_pool_kills_runaway_renders(t *testing.T) {
+	defer withFakeGhostscript(t, "exec sleep 10")()
+
+	pool := newRendererPool(1)
+
+	start := time.Now()
+	if err := pool.Render(nil, time.Second, 100*time.Millisecond); err == nil {
+		t.Fatal("Expected runaway render to fail")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Runaway render wasn't killed")
+	}
+}
+
+func Test_renderer_pool_queue_timeout(t *testing.T) {
+	defer withFakeGhostscript(t, "exec sleep 1")()
+
+	pool := newRendererPool(1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pool.Render(nil, time.Second, 5*time.Second)
+	}()
+
+	// Give the first render time to take the only slot
+	time.Sleep(200 * time.Millisecond)
+
+	if err := pool.Render(nil, 50*time.Millisecond, 5*time.Second); err != errRendererQueueTimeout {
+		t.Fatalf("Expected queue timeout, got %v", err)
+	}
+
+	wg.Wait()
+
+	if err := pool.Render(nil, time.Second, 5*time.Second); err != nil {
+		t.Fatalf("Expected render to succeed once the slot is free, got %v", err)
+	}
+}
+
+func Test_renderer_pool_runs_concurrently(t *testing.T) {
+	defer withFakeGhostscript(t, "exec sleep 0.5")()
+
+	pool := newRendererPool(4)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.Render(nil, time.Second, 5*time.Second); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("Renders didn't run concurrently, took %s", elapsed)
+	}
+}
+
+func Test_renderer_pool_idle_renders_yield(t *testing.T) {
+	defer withFakeGhostscript(t, "exec sleep 0.3")()
+
+	pool := newRendererPool(1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pool.Render(nil, time.Second, 5*time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A render queued behind the first one has to go before the idle one
+	var order []string
+	var mutex sync.Mutex
+	for _, name := range []string{"idle", "queued"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if name == "idle" {
+				pool.RenderIdle(nil, time.Second, 5*time.Second)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+				pool.Render(nil, time.Second, 5*time.Second)
+			}
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "queued" {
+		t.Fatalf("Expected the queued render to finish first, got %v", order)
+	}
+}
+
+func Test_renderer_pool_idle_render_timeout(t *testing.T) {
+	defer withFakeGhostscript(t, "exec sleep 1")()
+
+	pool := newRendererPool(1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pool.Render(nil, time.Second, 5*time.Second)
+	}()
+	defer wg.Wait()
+
+	// Give the first render time to take the only slot
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	if err := pool.RenderIdle(nil, 100*time.Millisecond, 5*time.Second); err != errRendererQueueTimeout {
+		t.Fatalf("Expected queue timeout, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("Expected the idle render to give up once the pool didn't go idle in time")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// rewriter rewrites the subresource URLs in a document fetched from baseURL so they're proxied
+// through serverURL, for documents proxied by the raw method.
+type rewriter struct {
+	Name    string // used in stats, e.g. farspark.gltf_process_time
+	MaxSize *int   // maximum source file size, from conf
+	Rewrite func(data []byte, baseURL *url.URL, serverURL *url.URL, opts rewriteOptions) ([]byte, error)
+}
+
+// rewriteOptions are raw method query parameters which control how documents are rewritten.
+type rewriteOptions struct {
+	TextureMaxDimension int      // when set, GLTF textures are scaled down to fit within it
+	TextureFormat       mimeType // when set, GLTF textures are transcoded to it
+
+	StripUnknownExtensions bool  // when set, GLTF extensions farspark doesn't know are removed
+	MaxBufferSize          int64 // when set, larger external GLTF buffers are removed
+}
+
+func (o rewriteOptions) rewritesTextures() bool {
+	return o.TextureMaxDimension > 0 || len(o.TextureFormat) > 0
+}
+
+// sanitizes reports whether GLTF documents are stripped of anything, which means they can't be
+// patched in place.
+func (o rewriteOptions) sanitizes() bool {
+	return o.StripUnknownExtensions || o.MaxBufferSize > 0
+}
+
+var (
+	gltfRewriter = rewriter{"gltf", &conf.MaxGLTFSrcFileSize, processGLTF}
+	glbRewriter  = rewriter{"gltf", &conf.MaxGLTFSrcFileSize, processGLB}
+	hlsRewriter  = rewriter{"hls", &conf.MaxSrcFileSize, rewriteHLS}
+	dashRewriter = rewriter{"dash", &conf.MaxSrcFileSize, rewriteDASH}
+	objRewriter  = rewriter{"obj", &conf.MaxSrcFileSize, rewriteOBJ}
+	mtlRewriter  = rewriter{"mtl", &conf.MaxSrcFileSize, rewriteMTL}
+	htmlRewriter = rewriter{"html", &conf.MaxSrcFileSize, rewriteHTML}
+)
+
+// Map from content type to the rewriter for it. Registering a rewriter here is all it takes for
+// the raw method to apply it.
+var rewriters = map[string]rewriter{
+	"model/gltf+json":               gltfRewriter,
+	"model/gltf-binary":             glbRewriter,
+	"application/vnd.apple.mpegurl": hlsRewriter,
+	"application/x-mpegurl":         hlsRewriter,
+	"audio/mpegurl":                 hlsRewriter,
+	"audio/x-mpegurl":               hlsRewriter,
+	"application/dash+xml":          dashRewriter,
+	"model/obj":                     objRewriter,
+	"model/mtl":                     mtlRewriter,
+	"text/html":                     htmlRewriter,
+}
+
+// Map from file extension to the content type it implies, for origins which serve files with a
+// generic content type.
+var rewriterExtensions = map[string]string{
+	".gltf": "model/gltf+json",
+	".glb":  "model/gltf-binary",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".obj":  "model/obj",
+	".mtl":  "model/mtl",
+	".html": "text/html",
+	".htm":  "text/html",
+}
+
+// Content types which say nothing about what a file is.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"text/plain":               true,
+}
+
+// findRewriter returns the content type of the document at sourceURL served with contentType,
+// and the rewriter for it, if there is one.
+func findRewriter(contentType string, sourceURL *url.URL) (string, rewriter, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	mediaType = strings.ToLower(mediaType)
+
+	if genericContentTypes[mediaType] {
+		if t, ok := rewriterExtensions[strings.ToLower(path.Ext(sourceURL.Path))]; ok {
+			mediaType = t
+		}
+	}
+
+	r, ok := rewriters[mediaType]
+	return mediaType, r, ok
+}
+
+// rewriteReference returns what the reference ref, relative to baseURL, should be replaced with.
+func rewriteReference(ref string, baseURL *url.URL, serverURL *url.URL) (string, error) {
+	oldURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	newURL, err := transformSubresourceURL(oldURL, baseURL, serverURL)
+	if err != nil {
+		return "", err
+	}
+	return newURL.String(), nil
+}
+
+// resolveReference returns the reference ref, relative to baseURL, as an absolute URL, for
+// references which can't be proxied but would break if left relative to us.
+func resolveReference(ref string, baseURL *url.URL) (string, error) {
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func testRewrite(t *testing.T, rewrite func([]byte, *url.URL, *url.URL, rewriteOptions) ([]byte, error), source string, in string, expected string) {
+	baseURL, err := url.Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, err := url.Parse("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := rewrite([]byte(in), baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != expected {
+		t.Fatalf("Unexpected output:\n%s\nexpected:\n%s", result, expected)
+	}
+}
+
+func Test_find_rewriter(t *testing.T) {
+	cases := []struct {
+		contentType string
+		url         string
+		expected    string
+	}{
+		{"model/gltf+json", "https://example.com/a", "model/gltf+json"},
+		{"application/vnd.apple.mpegurl; charset=utf-8", "https://example.com/a", "application/vnd.apple.mpegurl"},
+		{"Application/Dash+XML", "https://example.com/a", "application/dash+xml"},
+		{"application/octet-stream", "https://example.com/model.GLB", "model/gltf-binary"},
+		{"", "https://example.com/model.obj?v=1", "model/obj"},
+		{"text/plain", "https://example.com/model.mtl", "model/mtl"},
+		{"text/html; charset=utf-8", "https://example.com/", "text/html"},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		contentType, _, ok := findRewriter(c.contentType, u)
+		if !ok || contentType != c.expected {
+			t.Fatalf("Expected %s at %s to be rewritten as %s, got %s", c.contentType, c.url, c.expected, contentType)
+		}
+	}
+
+	u, _ := url.Parse("https://example.com/image.png")
+	if _, _, ok := findRewriter("image/png", u); ok {
+		t.Fatal("Expected images not to be rewritten")
+	}
+	u, _ = url.Parse("https://example.com/page.html")
+	if _, _, ok := findRewriter("image/png", u); ok {
+		t.Fatal("Expected extension to be ignored for specific content types")
+	}
+}
+
+func Test_rewrite_HLS(t *testing.T) {
+	in := "#EXTM3U\r\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"keys/key.bin\"\r\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\r\n" +
+		"#EXTINF:10.0,\r\n" +
+		"segment0.ts\r\n" +
+		"#EXTINF:10.0,\r\n" +
+		"https://cdn.example.com/segment1.ts\r\n" +
+		"#EXT-X-ENDLIST\r\n"
+	expected := "#EXTM3U\r\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS92aWRlby9rZXlzL2tleS5iaW4\"\r\n" +
+		"#EXT-X-MAP:URI=\"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS92aWRlby9pbml0Lm1wNA\"\r\n" +
+		"#EXTINF:10.0,\r\n" +
+		"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS92aWRlby9zZWdtZW50MC50cw\r\n" +
+		"#EXTINF:10.0,\r\n" +
+		"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9jZG4uZXhhbXBsZS5jb20vc2VnbWVudDEudHM\r\n" +
+		"#EXT-X-ENDLIST\r\n"
+
+	testRewrite(t, rewriteHLS, "https://example.com/video/playlist.m3u8", in, expected)
+}
+
+func Test_rewrite_HLS_unproxiable_keys(t *testing.T) {
+	in := "#EXTM3U\n" +
+		"#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI=\"skd://key-id\",KEYFORMAT=\"com.apple.streamingkeydelivery\"\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"data:text/plain;base64,AAECAwQFBgcICQoLDA0ODw==\"\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"HTTPS://example.com/key.bin\"\n" +
+		"#EXTINF:10.0,\n" +
+		"segment0.ts\n"
+	expected := "#EXTM3U\n" +
+		"#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI=\"skd://key-id\",KEYFORMAT=\"com.apple.streamingkeydelivery\"\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"data:text/plain;base64,AAECAwQFBgcICQoLDA0ODw==\"\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9rZXkuYmlu\"\n" +
+		"#EXTINF:10.0,\n" +
+		"http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS92aWRlby9zZWdtZW50MC50cw\n"
+
+	testRewrite(t, rewriteHLS, "https://example.com/video/playlist.m3u8", in, expected)
+}
+
+func Test_rewrite_DASH(t *testing.T) {
+	in := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate media="video_$Number$.m4s" initialization="video_init.mp4" startNumber="1"/>
+      <Representation id="1" bandwidth="800000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <BaseURL> audio/ </BaseURL>
+      <Representation id="2" bandwidth="128000">
+        <SegmentList>
+          <Initialization sourceURL="init.mp4"/>
+          <SegmentURL media='seg1.m4s'/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate media="https://example.com/dash/video_$Number$.m4s" initialization="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9kYXNoL3ZpZGVvX2luaXQubXA0" startNumber="1"/>
+      <Representation id="1" bandwidth="800000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <BaseURL>https://example.com/dash/audio/</BaseURL>
+      <Representation id="2" bandwidth="128000">
+        <SegmentList>
+          <Initialization sourceURL="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9kYXNoL2F1ZGlvL2luaXQubXA0"/>
+          <SegmentURL media="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9kYXNoL2F1ZGlvL3NlZzEubTRz"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+	testRewrite(t, rewriteDASH, "https://example.com/dash/manifest.mpd", in, expected)
+}
+
+func Test_rewrite_OBJ(t *testing.T) {
+	in := "# comment mtllib ignored.mtl\nmtllib  my model.mtl \r\nv 0 0 0\n"
+	expected := "# comment mtllib ignored.mtl\n" +
+		"mtllib  http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9tb2RlbHMvbXklMjBtb2RlbC5tdGw \r\n" +
+		"v 0 0 0\n"
+
+	testRewrite(t, rewriteOBJ, "https://example.com/models/model.obj", in, expected)
+}
+
+func Test_rewrite_MTL(t *testing.T) {
+	in := "newmtl wood\nKd 1 1 1\nmap_Kd -s 2 2 1 -clamp on textures/oak wood.png\n\tbump  -bm 0.5 wood_bump.png\n"
+	expected := "newmtl wood\nKd 1 1 1\n" +
+		"map_Kd -s 2 2 1 -clamp on http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9tb2RlbHMvdGV4dHVyZXMvb2FrJTIwd29vZC5wbmc\n" +
+		"\tbump  -bm 0.5 http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9tb2RlbHMvd29vZF9idW1wLnBuZw\n"
+
+	testRewrite(t, rewriteMTL, "https://example.com/models/model.mtl", in, expected)
+}
+
+func Test_rewrite_HTML(t *testing.T) {
+	in := `<html><head><link rel="stylesheet" href="style.css"></head>` +
+		`<body><img src='img/a.png' alt="a > b" srcset="a.png 1x, a@2x.png 2x">` +
+		`<a href="other.html">Other</a><a href="#top">Top</a><img src="data:image/png;base64,AA=="></body></html>`
+	expected := `<html><head><link rel="stylesheet" href="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL3N0eWxlLmNzcw"></head>` +
+		`<body><img src="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2ltZy9hLnBuZw" alt="a > b" srcset="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2EucG5n 1x, http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2FAMngucG5n 2x">` +
+		`<a href="https://example.com/site/other.html">Other</a><a href="#top">Top</a><img src="data:image/png;base64,AA=="></body></html>`
+
+	testRewrite(t, rewriteHTML, "https://example.com/site/index.html", in, expected)
+}
+
+func Test_rewrite_HTML_unquoted_attributes(t *testing.T) {
+	in := `<video poster=img/p.png src=v.mp4 controls></video><a href=other.html>Other</a>`
+	expected := `<video poster="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2ltZy9wLnBuZw" src="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL3YubXA0" controls></video>` +
+		`<a href="https://example.com/site/other.html">Other</a>`
+
+	testRewrite(t, rewriteHTML, "https://example.com/site/index.html", in, expected)
+}
+
+func Test_rewrite_HTML_skips_raw_text(t *testing.T) {
+	in := `<script src="app.js">document.write('<img src="a.png">')</script>` +
+		`<style>/* <link href="b.css"> */</style><!-- <img src="c.png"> --><img src="d.png">`
+	expected := `<script src="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2FwcC5qcw">document.write('<img src="a.png">')</script>` +
+		`<style>/* <link href="b.css"> */</style><!-- <img src="c.png"> --><img src="http://localhost:8080/0/raw/0/0/0/0/aHR0cHM6Ly9leGFtcGxlLmNvbS9zaXRlL2QucG5n">`
+
+	testRewrite(t, rewriteHTML, "https://example.com/site/index.html", in, expected)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/alexcesaro/statsd.v2"
@@ -26,12 +27,16 @@ const (
 	Raw
 	Extract
 	Thumbnail
+	Validate
+	Summary
 )
 
 var processingMethods = map[string]processingMethod{
 	"extract":   Extract,
 	"thumbnail": Thumbnail,
 	"raw":       Raw,
+	"validate":  Validate,
+	"summary":   Summary,
 }
 
 type processingOptions struct {
@@ -39,10 +44,40 @@ type processingOptions struct {
 	Index  int
 }
 
+type extractOptions struct {
+	Format    mimeType
+	Quality   int     // for lossy formats; 0 means the default
+	Timestamp float64 // in seconds; negative when frames are selected by index
+	DPI       int     // for PDFs; 0 means the default
+	Width     int     // for PDFs; takes precedence over DPI when set
+}
+
+// Default quality of lossy extract output formats.
+const defaultExtractQuality = 85
+
+func (o extractOptions) quality() int {
+	if o.Quality > 0 {
+		return o.Quality
+	}
+	return defaultExtractQuality
+}
+
+// extractResult is what's extracted from a source, shared by identical requests made at the same
+// time.
+type extractResult struct {
+	Data     []byte
+	MaxIndex int
+	Duration time.Duration
+}
+
 type thumbnailOptions struct {
-	SourceURL string
-	Width     int
-	Height    int
+	SourceURL    string
+	Width        int
+	Height       int
+	MaxDimension int      // when set instead of Width and Height, scales down to fit within it
+	Format       mimeType // empty to keep the source format
+	Signature    string
+	Expires      int64
 }
 
 type httpHandler struct {}
@@ -85,20 +120,158 @@ func parseThumbnailOptions(r *http.Request) (thumbnailOptions, error) {
 		return opts, errors.New("Invalid query string")
 	}
 
-	if opts.Width, err = strconv.Atoi(query.Get("w")); err != nil {
-		return opts, fmt.Errorf("Invalid width: %s", query.Get("w"))
+	if maxDimension := query.Get("max"); len(maxDimension) > 0 {
+		if opts.MaxDimension, err = strconv.Atoi(maxDimension); err != nil {
+			return opts, fmt.Errorf("Invalid max dimension: %s", maxDimension)
+		}
+
+		if opts.MaxDimension <= 0 {
+			return opts, errors.New("Requested size must be >0")
+		}
+	} else {
+		if opts.Width, err = strconv.Atoi(query.Get("w")); err != nil {
+			return opts, fmt.Errorf("Invalid width: %s", query.Get("w"))
+		}
+
+		if opts.Height, err = strconv.Atoi(query.Get("h")); err != nil {
+			return opts, fmt.Errorf("Invalid height: %s", query.Get("h"))
+		}
+
+		if opts.Width <= 0 || opts.Height <= 0 {
+			return opts, errors.New("Requested size must be >0")
+		}
 	}
 
-	if opts.Height, err = strconv.Atoi(query.Get("h")); err != nil {
-		return opts, fmt.Errorf("Invalid height: %s", query.Get("h"))
+	if opts.Width > conf.MaxDimension || opts.Height > conf.MaxDimension || opts.MaxDimension > conf.MaxDimension {
+		return opts, errors.New("Requested size is too big")
 	}
 
-	if opts.Width <= 0 || opts.Height <= 0 {
-		return opts, errors.New("Requested size must be >0")
+	if format := query.Get("format"); len(format) > 0 {
+		var ok bool
+		if opts.Format, ok = extractFormats[format]; !ok {
+			return opts, fmt.Errorf("Invalid format: %s", format)
+		}
 	}
 
-	if opts.Width > conf.MaxDimension || opts.Height > conf.MaxDimension {
-		return opts, errors.New("Requested size is too big")
+	opts.Signature = query.Get("sig")
+
+	if exp := query.Get("exp"); len(exp) > 0 {
+		if opts.Expires, err = strconv.ParseInt(exp, 10, 64); err != nil || opts.Expires <= 0 {
+			return opts, fmt.Errorf("Invalid expiry: %s", exp)
+		}
+	}
+
+	return opts, nil
+}
+
+func checkThumbnailSignature(opts thumbnailOptions) error {
+	if conf.AllowInsecure {
+		return nil
+	}
+
+	// Unsigned thumbnails are allowed unless signatures are required, but signatures which are
+	// given are still checked, so they can't be tampered with or used past their expiry
+	if len(opts.Signature) == 0 && !conf.RequireThumbnailSignatures {
+		return nil
+	}
+
+	message := thumbnailSignatureMessage(opts)
+	if err := validateSignature(opts.Signature, message); err != nil {
+		return err
+	}
+
+	if opts.Expires > 0 && time.Now().Unix() > opts.Expires {
+		return errExpiredSignature
+	}
+
+	return nil
+}
+
+// generateThumbnailURL returns a thumbnail URL on serverURL for opts, signed with the first
+// configured key. A zero expires produces a URL which never expires.
+func generateThumbnailURL(serverURL *url.URL, opts thumbnailOptions, expires time.Time) (*url.URL, error) {
+	path, err := url.Parse("/thumbnail/" + base64.RawURLEncoding.EncodeToString([]byte(opts.SourceURL)))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if opts.MaxDimension > 0 {
+		query.Set("max", strconv.Itoa(opts.MaxDimension))
+	} else {
+		query.Set("w", strconv.Itoa(opts.Width))
+		query.Set("h", strconv.Itoa(opts.Height))
+	}
+
+	if len(opts.Format) > 0 {
+		query.Set("format", strings.TrimPrefix(string(opts.Format), "image/"))
+	}
+
+	opts.Expires = 0
+	if !expires.IsZero() {
+		opts.Expires = expires.Unix()
+		query.Set("exp", strconv.FormatInt(opts.Expires, 10))
+	}
+
+	if len(conf.Keys) > 0 {
+		query.Set("sig", signMessage(thumbnailSignatureMessage(opts)))
+	}
+
+	path.RawQuery = query.Encode()
+	return serverURL.ResolveReference(path), nil
+}
+
+// Map from extract "format" query parameter to output MIME type.
+var extractFormats = map[string]mimeType{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"webp": "image/webp",
+}
+
+// Highest resolution PDF pages may be rendered at, in dots per inch.
+const maxExtractDPI = 600
+
+func parseExtractOptions(r *http.Request) (extractOptions, error) {
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return opts, errors.New("Invalid query string")
+	}
+
+	if format := query.Get("format"); len(format) > 0 {
+		var ok bool
+		if opts.Format, ok = extractFormats[format]; !ok {
+			return opts, fmt.Errorf("Invalid format: %s", format)
+		}
+	}
+
+	if timestamp := query.Get("t"); len(timestamp) > 0 {
+		if opts.Timestamp, err = strconv.ParseFloat(timestamp, 64); err != nil || opts.Timestamp < 0 {
+			return opts, fmt.Errorf("Invalid timestamp: %s", timestamp)
+		}
+	}
+
+	if quality := query.Get("q"); len(quality) > 0 {
+		if opts.Quality, err = strconv.Atoi(quality); err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			return opts, fmt.Errorf("Invalid quality: %s", quality)
+		}
+	}
+
+	if dpi := query.Get("dpi"); len(dpi) > 0 {
+		if opts.DPI, err = strconv.Atoi(dpi); err != nil || opts.DPI <= 0 || opts.DPI > maxExtractDPI {
+			return opts, fmt.Errorf("Invalid DPI: %s", dpi)
+		}
+	}
+
+	if width := query.Get("w"); len(width) > 0 {
+		if opts.Width, err = strconv.Atoi(width); err != nil || opts.Width <= 0 {
+			return opts, fmt.Errorf("Invalid width: %s", width)
+		}
+		if opts.Width > conf.MaxDimension {
+			return opts, errors.New("Requested size is too big")
+		}
 	}
 
 	return opts, nil
@@ -115,7 +288,7 @@ func parseLegacyOptions(r *http.Request) (string, processingOptions, error) {
 		return "", po, errors.New("Invalid path")
 	}
 
-	// path part 0 corresponds to signature of rest of path, which we no longer care about
+	// path part 0 corresponds to signature of rest of path, which is checked by checkLegacySignature
 
 	if r, ok := processingMethods[parts[1]]; ok {
 		po.Method = r
@@ -125,7 +298,7 @@ func parseLegacyOptions(r *http.Request) (string, processingOptions, error) {
 
 	// path part 2-4 corresponds to obsolete image transformation options (width, height, enlarge)
 
-	if po.Index, err = strconv.Atoi(parts[5]); err != nil {
+	if po.Index, err = strconv.Atoi(parts[5]); err != nil || po.Index < 0 {
 		return "", po, fmt.Errorf("Invalid index: %s", parts[5])
 	}
 
@@ -137,6 +310,78 @@ func parseLegacyOptions(r *http.Request) (string, processingOptions, error) {
 	return string(filename), po, nil
 }
 
+// parseRewriteOptions parses the raw method's query parameters: texture_max and texture_format,
+// which scale down and transcode GLTF textures, and strip_extensions and max_buffer_size, which
+// strip unknown extensions and oversized buffers from GLTF documents.
+func parseRewriteOptions(r *http.Request) (rewriteOptions, error) {
+	var opts rewriteOptions
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return opts, errors.New("Invalid query string")
+	}
+
+	if maxDimension := query.Get("texture_max"); len(maxDimension) > 0 {
+		if opts.TextureMaxDimension, err = strconv.Atoi(maxDimension); err != nil || opts.TextureMaxDimension <= 0 || opts.TextureMaxDimension > conf.MaxDimension {
+			return opts, fmt.Errorf("Invalid texture max dimension: %s", maxDimension)
+		}
+	}
+
+	if format := query.Get("texture_format"); len(format) > 0 {
+		var ok bool
+		if opts.TextureFormat, ok = extractFormats[format]; !ok {
+			return opts, fmt.Errorf("Invalid texture format: %s", format)
+		}
+	}
+
+	if strip := query.Get("strip_extensions"); len(strip) > 0 {
+		if opts.StripUnknownExtensions, err = strconv.ParseBool(strip); err != nil {
+			return opts, fmt.Errorf("Invalid strip_extensions: %s", strip)
+		}
+	}
+
+	if maxBufferSize := query.Get("max_buffer_size"); len(maxBufferSize) > 0 {
+		if opts.MaxBufferSize, err = strconv.ParseInt(maxBufferSize, 10, 64); err != nil || opts.MaxBufferSize <= 0 {
+			return opts, fmt.Errorf("Invalid max buffer size: %s", maxBufferSize)
+		}
+	}
+
+	return opts, nil
+}
+
+func checkLegacySignature(r *http.Request) error {
+	if conf.AllowInsecure {
+		return nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		return errInvalidSignature
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return errInvalidSignature
+	}
+
+	var expires int64
+	if exp := query.Get("exp"); len(exp) > 0 {
+		if expires, err = strconv.ParseInt(exp, 10, 64); err != nil || expires <= 0 {
+			return errInvalidSignature
+		}
+	}
+
+	if err := validateSignature(parts[0], legacySignatureMessage("/"+parts[1], query)); err != nil {
+		return err
+	}
+
+	if expires > 0 && time.Now().Unix() > expires {
+		return errExpiredSignature
+	}
+
+	return nil
+}
+
 func logResponse(status int, msg string) {
 	var color int
 
@@ -169,7 +414,7 @@ func writeCORS(r *http.Request, rw http.ResponseWriter) {
 	}
 	rw.Header().Add("Vary", "Origin")
 	rw.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
-	rw.Header().Set("Access-Control-Expose-Headers", "Age, Date, Content-Length, Content-Range, X-Content-Duration, X-Content-Index, X-Max-Content-Index, X-Cache, X-Varnish")
+	rw.Header().Set("Access-Control-Expose-Headers", "Age, Date, Content-Length, Content-Range, X-Content-Duration, X-Content-Index, X-Max-Content-Index, X-Cache, X-Varnish, X-Farspark-Cache")
 }
 
 func addCacheControlHeadersIfMissing(header http.Header) {
@@ -178,6 +423,29 @@ func addCacheControlHeadersIfMissing(header http.Header) {
 	}
 }
 
+// limitRewrittenCacheControl caps how long a rewritten document may be cached downstream to half
+// the time the subresource URLs signed into it are valid for, the most it can have been kept in
+// the raw cache for, so no cache holds on to it after its links expire.
+func limitRewrittenCacheControl(header http.Header) {
+	if conf.SubresourceURLTTL <= 0 {
+		return
+	}
+	maxAge := conf.SubresourceURLTTL / 2
+
+	var directives []string
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		name := strings.ToLower(strings.SplitN(directive, "=", 2)[0])
+		if len(directive) == 0 || name == "max-age" || name == "s-maxage" {
+			continue
+		}
+		directives = append(directives, directive)
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", maxAge))
+	header.Set("Cache-Control", strings.Join(directives, ", "))
+	header.Del("Expires")
+}
+
 func respondWithMedia(reqID string, r *http.Request, rw http.ResponseWriter, data []byte, mediaURL string, mimeType string, duration time.Duration) {
 	gzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && conf.GZipCompression > 0
 
@@ -215,7 +483,7 @@ func respondWithError(reqID string, rw http.ResponseWriter, err farsparkError) {
 
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
-		if k == "set-cookie" || k == "set-cookie2" || strings.HasPrefix(k, "x-amz") || strings.HasPrefix(k, "X-Amz") {
+		if k == "Set-Cookie" || k == "Set-Cookie2" || strings.HasPrefix(k, "X-Amz") {
 			continue
 		}
 
@@ -232,6 +500,11 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	defer func() {
 		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				// Responses which were cut short have already been logged
+				stats.Increment("farspark.request_errors")
+				panic(r)
+			}
 			if err, ok := r.(farsparkError); ok {
 				respondWithError(reqID, rw, err)
 			} else {
@@ -244,6 +517,11 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[%s] %s: %s\n", reqID, r.Method, r.URL.RequestURI())
 
+	if strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+		serveAdmin(reqID, rw, r)
+		return
+	}
+
 	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
 		panic(invalidMethodErr)
 	}
@@ -266,81 +544,210 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			panic(newError(400, fmt.Sprintf("Error: %+v", err), "Error parsing options"))
 		}
 
+		if err := checkThumbnailSignature(opts); err == errExpiredSignature {
+			panic(expiredSignatureErr)
+		} else if err != nil {
+			panic(invalidSignatureErr)
+		}
+
+		if err := checkSourceURL(opts.SourceURL); err != nil {
+			panic(err)
+		}
+
 		if r.Method != http.MethodGet {
 			panic(invalidMethodErr)
 		}
 		t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
 		tThumbnail := stats.NewTiming()
 
-		imageBytes, imageMimeType, err := downloadMedia(opts.SourceURL)
-		if err != nil {
-			panic(newError(404, fmt.Sprintf("Error: %+v", err), "Media is unreachable"))
+		version := sourceVersion(opts.SourceURL)
+		var refetched *downloadResult // the source, if revalidating it found it had changed
+		if farsparkCache != nil {
+			if cached, ok := readCachedResponse(getThumbnailCacheKey(opts, version)); ok {
+				var current bool
+				if current, refetched = revalidateSource(opts.SourceURL, conf.MaxThumbnailSrcFileSize); current {
+					rw.Header().Set(cacheStatusHeader, "HIT")
+					writeCORS(r, rw)
+					respondWithMedia(reqID, r, rw, cached.Body, opts.SourceURL, cached.Header.Get("Content-Type"), t.Since())
+					stats.Increment("farspark.thumbnail_cache_hits")
+					tThumbnail.Send("farspark.thumbnail_time")
+					return
+				}
+				version = sourceVersion(opts.SourceURL)
+			}
+			rw.Header().Set(cacheStatusHeader, "MISS")
+			stats.Increment("farspark.thumbnail_cache_misses")
 		}
 
-		outputBytes, err := processImage(imageBytes, imageMimeType, opts.Width, opts.Height, t)
-		if err != nil {
-			stats.Increment("farspark.thumbnail_errors")
-			panic(newError(500, fmt.Sprintf("Error: %+v", err), "Error occurred while generating thumbnail"))
+		// Identical thumbnails requested at the same time are only generated once
+		result, shared := processingFlights.Do(getThumbnailCacheKey(opts, version), func() interface{} {
+			var imageBytes []byte
+			var imageMimeType mimeType
+			var err error
+			if refetched != nil {
+				imageBytes, imageMimeType = refetched.data, refetched.mimeType
+			} else if imageBytes, imageMimeType, err = downloadMedia(opts.SourceURL, conf.MaxThumbnailSrcFileSize); err != nil {
+				panic(wrapError(err, 404, "Media is unreachable"))
+			}
+
+			outputMimeType := imageMimeType
+			if len(opts.Format) > 0 {
+				outputMimeType = opts.Format
+			}
+
+			var outputBytes []byte
+			if opts.MaxDimension > 0 {
+				outputBytes, err = downscaleImage(imageBytes, outputMimeType, opts.MaxDimension, t)
+			} else {
+				outputBytes, err = processImage(imageBytes, outputMimeType, opts.Width, opts.Height, t)
+			}
+			if err != nil {
+				stats.Increment("farspark.thumbnail_errors")
+				panic(newError(500, fmt.Sprintf("Error: %+v", err), "Error occurred while generating thumbnail"))
+			}
+			t.Check()
+
+			output := cachedResponse{http.Header{"Content-Type": {outputMimeType}}, outputBytes}
+			if farsparkCache != nil && len(outputBytes) <= conf.ThumbnailCacheMaxSize {
+				// Keyed by the version which was just downloaded
+				writeCachedResponse(getThumbnailCacheKey(opts, sourceVersion(opts.SourceURL)), output, 0)
+			}
+			return output
+		})
+		if shared {
+			stats.Increment("farspark.coalesced_requests")
 		}
-		t.Check()
+		output := result.(cachedResponse)
+		outputBytes, outputMimeType := output.Body, output.Header.Get("Content-Type")
 
 		writeCORS(r, rw)
 
-		respondWithMedia(reqID, r, rw, outputBytes, opts.SourceURL, imageMimeType, t.Since())
+		respondWithMedia(reqID, r, rw, outputBytes, opts.SourceURL, outputMimeType, t.Since())
 		stats.Increment("farspark.thumbnail_ok")
 		tThumbnail.Send("farspark.thumbnail_time")
 
 	case Extract:
+		if err := checkLegacySignature(r); err == errExpiredSignature {
+			panic(expiredSignatureErr)
+		} else if err != nil {
+			panic(invalidSignatureErr)
+		}
+
 		mediaURL, procOpt, err := parseLegacyOptions(r)
 		if err != nil {
 			panic(newError(400, err.Error(), "Error parsing options"))
 		}
 
+		if err := checkSourceURL(mediaURL); err != nil {
+			panic(err)
+		}
+
 		if r.Method != http.MethodGet {
 			panic(invalidMethodErr)
 		}
 
+		extractOpts, err := parseExtractOptions(r)
+		if err != nil {
+			panic(newError(400, err.Error(), "Error parsing options"))
+		}
+
 		var b []byte = nil
 		var maxIndex int
-		outputMimeType := "image/png"
+		var duration time.Duration
+		outputMimeType := extractOpts.Format
 
 		t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
 		tProcess := stats.NewTiming()
 
-		contentsKey := getIndexContentsCacheKey(mediaURL, procOpt.Index)
+		// Anything cached from the source is only reused while it's known to be current
+		var sourceCurrent bool
+		var refetched *downloadResult // the source, if revalidating it found it had changed
+		if farsparkCache != nil {
+			sourceCurrent, refetched = revalidateSource(mediaURL, conf.MaxExtractSrcFileSize)
+		}
+		version := sourceVersion(mediaURL)
+		contentsKey := getIndexContentsCacheKey(mediaURL, version, procOpt.Index, extractOpts.cacheVariant())
 
 		// Optimization: use the local page contents cache and skip download if possible
-		if farsparkCache != nil && farsparkCache.Has(contentsKey) {
-			outData, contentErr := farsparkCache.Read(contentsKey)
-			maxIndexBytes, maxIndexErr := farsparkCache.Read(getMaxIndexCacheKey(mediaURL))
+		if sourceCurrent && farsparkCache.Has(contentsKey) {
+			outData, contentErr := farsparkCache.Get(contentsKey)
+			maxIndexBytes, maxIndexErr := farsparkCache.Get(getMaxIndexCacheKey(mediaURL, version))
 			maxIndexParsed, maxIndexParseErr := strconv.Atoi(string(maxIndexBytes))
 
 			if contentErr == nil && maxIndexErr == nil && maxIndexParseErr == nil {
 				b = outData
 				maxIndex = maxIndexParsed
 			}
-		} else {
-			downloadBytes, downloadMimeType, err := downloadMedia(mediaURL)
-
-			if err != nil {
-				panic(newError(404, err.Error(), "Media is unreachable"))
-			}
 
-			if downloadMimeType != "application/pdf" {
-				panic(newError(400, err.Error(), "Media type has no subresources to extract"))
+			if durationBytes, err := farsparkCache.Get(getDurationCacheKey(mediaURL, version)); err == nil {
+				if seconds, err := strconv.ParseFloat(string(durationBytes), 64); err == nil {
+					duration = time.Duration(seconds * float64(time.Second))
+				}
 			}
-
-			t.Check()
-
-			processedBytes, processedMaxIndex, err := extractPDFPage(downloadBytes, mediaURL, procOpt.Index, outputMimeType)
-
-			if err != nil {
-				stats.Increment("farspark.process_errors")
-				panic(newError(500, err.Error(), "Error occurred while processing media"))
+		} else {
+			// Identical contents requested at the same time are only extracted once
+			result, shared := processingFlights.Do(contentsKey, func() interface{} {
+				var downloadBytes []byte
+				var downloadMimeType mimeType
+				var err error
+
+				// Office documents which were converted before are extracted from the converted PDF
+				if refetched != nil {
+					downloadBytes, downloadMimeType = refetched.data, refetched.mimeType
+				} else if pdfBytes, ok := readConvertedPDF(mediaURL, version); ok && sourceCurrent {
+					downloadBytes, downloadMimeType = pdfBytes, "application/pdf"
+				} else {
+					downloadBytes, downloadMimeType, err = downloadMedia(mediaURL, conf.MaxExtractSrcFileSize)
+
+					if err != nil {
+						panic(wrapError(err, 404, "Media is unreachable"))
+					}
+				}
+
+				t.Check()
+
+				var processedBytes []byte
+				var processedMaxIndex int
+				var processedDuration time.Duration
+
+				if _, ok := officeMimeTypes[downloadMimeType]; ok {
+					downloadBytes, err = convertOfficeToPDF(downloadBytes, downloadMimeType, mediaURL)
+					if err != nil {
+						stats.Increment("farspark.office_conversion_errors")
+						panic(newError(500, err.Error(), "Error occurred while converting document"))
+					}
+
+					downloadMimeType = "application/pdf"
+					t.Check()
+				}
+
+				if downloadMimeType == "application/pdf" {
+					processedBytes, processedMaxIndex, err = extractPDFPage(downloadBytes, mediaURL, procOpt.Index, extractOpts)
+					if err == nil {
+						prerenderPDFPages(downloadBytes, mediaURL, procOpt.Index, extractOpts)
+					}
+				} else if videoMimeTypes[downloadMimeType] {
+					processedBytes, processedMaxIndex, processedDuration, err = extractVideoFrame(downloadBytes, mediaURL, procOpt.Index, extractOpts, t)
+				} else if animatedMimeTypes[downloadMimeType] {
+					processedBytes, processedMaxIndex, err = extractAnimationFrame(downloadBytes, downloadMimeType, mediaURL, procOpt.Index, extractOpts)
+				} else {
+					panic(newError(400, fmt.Sprintf("Unsupported media type: %s", downloadMimeType), "Media type has no subresources to extract"))
+				}
+
+				if err == errIndexOutOfRange {
+					panic(newError(400, err.Error(), "Requested index is out of range"))
+				} else if err != nil {
+					stats.Increment("farspark.process_errors")
+					panic(wrapError(err, 500, "Error occurred while processing media"))
+				}
+
+				return extractResult{processedBytes, processedMaxIndex, processedDuration}
+			})
+			if shared {
+				stats.Increment("farspark.coalesced_requests")
 			}
-
-			b = processedBytes
-			maxIndex = processedMaxIndex
+			extracted := result.(extractResult)
+			b, maxIndex, duration = extracted.Data, extracted.MaxIndex, extracted.Duration
 		}
 
 		t.Check()
@@ -352,56 +759,263 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			rw.Header().Set("X-Max-Content-Index", strconv.Itoa(maxIndex))
 		}
 
+		if duration > 0 {
+			rw.Header().Set("X-Content-Duration", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64))
+		}
+
 		respondWithMedia(reqID, r, rw, b, mediaURL, outputMimeType, t.Since())
 		stats.Increment("farspark.process_ok")
 		tProcess.Send("farspark.process_time")
 	case Raw:
+		if err := checkLegacySignature(r); err == errExpiredSignature {
+			panic(expiredSignatureErr)
+		} else if err != nil {
+			panic(invalidSignatureErr)
+		}
+
 		mediaURL, _, err := parseLegacyOptions(r)
 		if err != nil {
 			panic(newError(400, err.Error(), "Error parsing options"))
 		}
 
+		if err := checkSourceURL(mediaURL); err != nil {
+			panic(err)
+		}
+
+		rewriteOpts, err := parseRewriteOptions(r)
+		if err != nil {
+			panic(newError(400, err.Error(), "Error parsing options"))
+		}
+
 		tRaw := stats.NewTiming()
+
+		// Small GLTFs and images are kept in the output cache, unless only part of one is requested
+		useRawCache := farsparkCache != nil && conf.RawCacheMaxSize > 0 && len(r.Header.Get("Range")) == 0
+		rawCacheKey := getRawCacheKey(mediaURL, sourceVersion(mediaURL), rewriteOpts)
+		if useRawCache {
+			if cached, ok := readCachedResponse(rawCacheKey); ok {
+				copyHeader(rw.Header(), cached.Header)
+				rw.Header().Set("Server", "Farspark")
+				rw.Header().Set(cacheStatusHeader, "HIT")
+				addCacheControlHeadersIfMissing(rw.Header())
+				if baseURL, err := url.Parse(mediaURL); err == nil && conf.ServerURL != nil {
+					if _, _, rewritten := findRewriter(cached.Header.Get("Content-Type"), baseURL); rewritten {
+						limitRewrittenCacheControl(rw.Header())
+					}
+				}
+				writeCORS(r, rw)
+				rw.WriteHeader(200)
+				if r.Method == http.MethodGet {
+					rw.Write(cached.Body)
+				}
+				stats.Increment("farspark.raw_cache_hits")
+				stats.Increment("farspark.raw_ok")
+				tRaw.Send("farspark.raw_time")
+				return
+			}
+			rw.Header().Set(cacheStatusHeader, "MISS")
+			stats.Increment("farspark.raw_cache_misses")
+		}
+
 		res, err := streamMedia(mediaURL, r)
 
 		if err != nil {
-			panic(newError(500, err.Error(), "Error occurred while streaming media"))
+			panic(wrapError(err, 500, "Error occurred while streaming media"))
 		}
 
 		defer res.Body.Close()
 		body := res.Body
 
-		isGLTF := res.Header.Get("Content-Type") == "model/gltf+json"
+		baseURL, err := url.Parse(mediaURL)
+		if err != nil {
+			panic(newError(500, err.Error(), "Invalid base URL"))
+		}
+
+		contentType, rewriter, hasRewriter := findRewriter(res.Header.Get("Content-Type"), baseURL)
 		expectBody := r.Method != http.MethodHead && r.Method != http.MethodOptions
 		shouldRewrite := conf.ServerURL != nil
-		if isGLTF && expectBody && shouldRewrite {
-			tGLTF := stats.NewTiming()
-			contents, err := ioutil.ReadAll(body)
-			if err != nil {
-				stats.Increment("farspark.gltf_read_errors")
-				panic(newError(500, err.Error(), "Error occurred while reading content"))
+		var transformedLength int
+		var patchedStream bool
+		var contents []byte // the whole body, when it has been read
+		tRewrite := stats.NewTiming()
+		if hasRewriter && expectBody && shouldRewrite {
+
+			if contentType == "model/gltf+json" && conf.GLTFPatchInPlace && !rewriteOpts.sanitizes() {
+				// Patched while it's copied to the client, so it's never held in memory
+				limitedBody, err := limitMediaResponse(res, conf.MaxGLTFSrcFileSize)
+				if err != nil {
+					stats.Increment("farspark.gltf_read_errors")
+					panic(wrapError(err, 500, "Error occurred while reading content"))
+				}
+				pr, pw := io.Pipe()
+				defer pr.Close()
+				go func() {
+					pw.CloseWithError(patchGLTF(limitedBody, pw, baseURL, conf.ServerURL, rewriteOpts))
+				}()
+				body = pr
+				patchedStream = true
+			} else {
+				original, err := readAndCheckMediaResponse(res, *rewriter.MaxSize)
+				if err != nil {
+					stats.Increment(fmt.Sprintf("farspark.%s_read_errors", rewriter.Name))
+					panic(wrapError(err, 500, "Error occurred while reading content"))
+				}
+				transformed, err := rewriter.Rewrite(original, baseURL, conf.ServerURL, rewriteOpts)
+				if err != nil {
+					stats.Increment(fmt.Sprintf("farspark.%s_xform_errors", rewriter.Name))
+					panic(wrapError(err, 500, fmt.Sprintf("Error occurred while transforming %s", strings.ToUpper(rewriter.Name))))
+				}
+				contents = transformed
+				transformedLength = len(transformed)
+				tRewrite.Send(fmt.Sprintf("farspark.%s_process_time", rewriter.Name))
+				stats.Increment(fmt.Sprintf("farspark.%s_process_ok", rewriter.Name))
 			}
-			baseURL, err := url.Parse(mediaURL)
-			if err != nil {
-				panic(newError(500, err.Error(), "Invalid GLTF base URL"))
+		}
+
+		cacheTTL := rawCacheTTL(res.Header, transformedLength > 0)
+		if useRawCache && r.Method == http.MethodGet && res.StatusCode == 200 && !patchedStream && isRawCacheable(contentType) && cacheTTL > 0 {
+			if contents == nil && res.ContentLength >= 0 && res.ContentLength <= int64(conf.RawCacheMaxSize) {
+				if contents, err = readAndCheckMediaResponse(res, conf.RawCacheMaxSize); err != nil {
+					panic(wrapError(err, 500, "Error occurred while reading content"))
+				}
 			}
-			transformed, err := processGLTF(contents, baseURL, conf.ServerURL)
-			if err != nil {
-				stats.Increment("farspark.gltf_xform_errors")
-				panic(newError(500, err.Error(), "Error occurred while transforming GLTF"))
+			if contents != nil && len(contents) <= conf.RawCacheMaxSize {
+				// copyHeader leaves out the origin's cookies, so they aren't replayed to every client
+				header := make(http.Header)
+				copyHeader(header, res.Header)
+				header.Set("Content-Length", strconv.Itoa(len(contents)))
+				writeCachedResponse(rawCacheKey, cachedResponse{header, contents}, cacheTTL)
+				writeSourceURL(mediaURL, cacheTTL)
 			}
-			body = ioutil.NopCloser(bytes.NewReader(transformed))
-			tGLTF.Send("farspark.gltf_process_time")
-			stats.Increment("farspark.gltf_process_ok")
+		}
+		if contents != nil {
+			body = ioutil.NopCloser(bytes.NewReader(contents))
 		}
 
 		copyHeader(rw.Header(), res.Header)
+		if transformedLength > 0 {
+			// The origin's length is for the content before it was rewritten
+			rw.Header().Set("Content-Length", strconv.Itoa(transformedLength))
+		}
+		if patchedStream {
+			rw.Header().Del("Content-Length")
+		}
 		rw.Header().Set("Server", "Farspark")
 		addCacheControlHeadersIfMissing(rw.Header()) // If origin has no cache control, we assume farspark CDN will cache.
+		if hasRewriter && shouldRewrite {
+			limitRewrittenCacheControl(rw.Header())
+		}
 		writeCORS(r, rw)
 		rw.WriteHeader(res.StatusCode)
-		io.Copy(rw, body)
+		_, err = io.Copy(rw, body)
+		if patchedStream {
+			tRewrite.Send("farspark.gltf_process_time")
+			if err != nil {
+				// The status has already been sent, so all we can do is cut the response short
+				logResponse(500, fmt.Sprintf("[%s] Error occurred while patching GLTF: %s", reqID, err))
+				stats.Increment("farspark.gltf_xform_errors")
+				panic(http.ErrAbortHandler)
+			}
+			stats.Increment("farspark.gltf_process_ok")
+		}
 		stats.Increment("farspark.raw_ok")
 		tRaw.Send("farspark.raw_time")
+	case Validate:
+		if err := checkLegacySignature(r); err == errExpiredSignature {
+			panic(expiredSignatureErr)
+		} else if err != nil {
+			panic(invalidSignatureErr)
+		}
+
+		mediaURL, _, err := parseLegacyOptions(r)
+		if err != nil {
+			panic(newError(400, err.Error(), "Error parsing options"))
+		}
+
+		if err := checkSourceURL(mediaURL); err != nil {
+			panic(err)
+		}
+
+		if r.Method != http.MethodGet {
+			panic(invalidMethodErr)
+		}
+
+		t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
+		tValidate := stats.NewTiming()
+
+		data, _, err := downloadMedia(mediaURL, conf.MaxGLTFSrcFileSize)
+		if err != nil {
+			panic(wrapError(err, 404, "Media is unreachable"))
+		}
+
+		report, err := validateGLTF(data)
+		if err != nil {
+			stats.Increment("farspark.validate_errors")
+			panic(newError(422, err.Error(), "Media is not a GLTF document"))
+		}
+		t.Check()
+
+		reportBytes, err := json.Marshal(report)
+		if err != nil {
+			panic(newUnexpectedError(err, 4))
+		}
+
+		writeCORS(r, rw)
+
+		respondWithMedia(reqID, r, rw, reportBytes, mediaURL, "application/json", t.Since())
+		stats.Increment("farspark.validate_ok")
+		tValidate.Send("farspark.validate_time")
+	case Summary:
+		if err := checkLegacySignature(r); err == errExpiredSignature {
+			panic(expiredSignatureErr)
+		} else if err != nil {
+			panic(invalidSignatureErr)
+		}
+
+		mediaURL, _, err := parseLegacyOptions(r)
+		if err != nil {
+			panic(newError(400, err.Error(), "Error parsing options"))
+		}
+
+		if err := checkSourceURL(mediaURL); err != nil {
+			panic(err)
+		}
+
+		if r.Method != http.MethodGet {
+			panic(invalidMethodErr)
+		}
+
+		baseURL, err := url.Parse(mediaURL)
+		if err != nil {
+			panic(newError(500, err.Error(), "Invalid base URL"))
+		}
+
+		t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
+		tSummary := stats.NewTiming()
+
+		data, _, err := downloadMedia(mediaURL, conf.MaxGLTFSrcFileSize)
+		if err != nil {
+			panic(wrapError(err, 404, "Media is unreachable"))
+		}
+
+		// Image fetches are only started while they'd finish before the request times out
+		imageDeadline := t.StartTime.Add(time.Duration(conf.WriteTimeout-conf.DownloadTimeout) * time.Second)
+		summary, err := summarizeGLTF(data, baseURL, fetchImageHeader, imageDeadline)
+		if err != nil {
+			stats.Increment("farspark.summary_errors")
+			panic(newError(422, err.Error(), "Media is not a GLTF document"))
+		}
+		t.Check()
+
+		summaryBytes, err := json.Marshal(summary)
+		if err != nil {
+			panic(newUnexpectedError(err, 4))
+		}
+
+		writeCORS(r, rw)
+
+		respondWithMedia(reqID, r, rw, summaryBytes, mediaURL, "application/json", t.Since())
+		stats.Increment("farspark.summary_ok")
+		tSummary.Send("farspark.summary_time")
 	}
 }
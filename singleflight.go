@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+type flightCall struct {
+	done       chan struct{}
+	result     interface{}
+	panicked   bool
+	panicValue interface{}
+}
+
+// flightGroup coalesces concurrent calls with the same key, so only the first runs and the others
+// wait for it and share its result. Results are shared as they are, so callers mustn't modify
+// them.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+var (
+	downloadFlights   flightGroup // keyed by source cache key and size limit
+	processingFlights flightGroup // keyed by the cache key of the output
+)
+
+// Do runs fn and returns its result, unless a call with the same key is already running, in which
+// case it waits for that and returns its result instead, along with true. If fn panics, e.g. with
+// a farsparkError, every caller panics with the same value.
+func (g *flightGroup) Do(key string, fn func() interface{}) (interface{}, bool) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-call.done
+		if call.panicked {
+			panic(call.panicValue)
+		}
+		return call.result, true
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			call.panicked, call.panicValue = true, r
+		}
+
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+
+		if call.panicked {
+			panic(call.panicValue)
+		}
+	}()
+
+	call.result = fn()
+	return call.result, false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_flight_group_shares_results(t *testing.T) {
+	var group flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	shared := make([]bool, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], shared[i] = group.Do("key", func() interface{} {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "result"
+			})
+		}(i)
+	}
+
+	// Give every caller time to join the first one's call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected one call, got %d", calls)
+	}
+	var sharedCount int
+	for i, result := range results {
+		if result != "result" {
+			t.Fatalf("Expected every caller to get the result, got %v", result)
+		}
+		if shared[i] {
+			sharedCount++
+		}
+	}
+	if sharedCount != 4 {
+		t.Fatalf("Expected 4 callers to share the result, got %d", sharedCount)
+	}
+
+	if result, shared := group.Do("key", func() interface{} { return "again" }); result != "again" || shared {
+		t.Fatal("Expected a finished call not to be shared")
+	}
+}
+
+func Test_flight_group_shares_panics(t *testing.T) {
+	var group flightGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	recovered := make(chan interface{}, 2)
+	call := func(fn func() interface{}) {
+		defer func() { recovered <- recover() }()
+		group.Do("key", fn)
+	}
+
+	go call(func() interface{} {
+		close(started)
+		<-release
+		panic(newError(404, "Not found", "Media is unreachable"))
+	})
+	<-started
+	go call(func() interface{} { return nil })
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err, ok := (<-recovered).(farsparkError); !ok || err.StatusCode != 404 {
+			t.Fatalf("Expected every caller to panic with the error, got %v", err)
+		}
+	}
+}
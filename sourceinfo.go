@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long info about stale sources is kept once they go stale, while they can be revalidated.
+// Sources which can't be revalidated are forgotten as soon as they're stale.
+const staleSourceInfoTTL = 7 * 24 * time.Hour
+
+// sourceInfo is what's remembered about a source downloaded from its origin, to tell when it has
+// to be fetched again.
+type sourceInfo struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	CacheControl string    `json:"cacheControl,omitempty"`
+	FreshUntil   time.Time `json:"freshUntil"`
+	Version      string    `json:"version"`    // a hash of the contents; part of the keys of everything derived from them
+	BodyCached   bool      `json:"bodyCached"` // whether the contents are cached too
+}
+
+// getSourceKeyPrefix returns the prefix of the keys of everything cached for the source at url,
+// so it can all be found and purged together.
+func getSourceKeyPrefix(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return base64.RawURLEncoding.EncodeToString(sum[:16]) + "."
+}
+
+func getSourceCacheKey(url string) string {
+	return getSourceKeyPrefix(url) + "src"
+}
+
+func getSourceInfoCacheKey(url string) string {
+	return getSourceKeyPrefix(url) + "info"
+}
+
+// getSourceURLCacheKey returns the key under which the URL of a source is recorded when things
+// derived from it are cached without any info about it, like raw responses.
+func getSourceURLCacheKey(url string) string {
+	return getSourceKeyPrefix(url) + "url"
+}
+
+func isSourceInfoCacheKey(key string) bool {
+	return strings.HasSuffix(key, ".info")
+}
+
+func isSourceURLCacheKey(key string) bool {
+	return strings.HasSuffix(key, ".url")
+}
+
+func contentVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+func readSourceInfo(url string) (sourceInfo, bool) {
+	var info sourceInfo
+	if farsparkCache == nil {
+		return info, false
+	}
+
+	data, err := farsparkCache.Get(getSourceInfoCacheKey(url))
+	if err != nil || json.Unmarshal(data, &info) != nil {
+		return info, false
+	}
+	return info, true
+}
+
+// writeSourceInfo caches info for as long as it's useful, or deletes it if it no longer is.
+func writeSourceInfo(url string, info sourceInfo) {
+	ttl := info.ttl()
+	if ttl <= 0 {
+		farsparkCache.Delete(getSourceInfoCacheKey(url))
+		return
+	}
+	if data, err := json.Marshal(info); err == nil {
+		farsparkCache.Put(getSourceInfoCacheKey(url), data, ttl)
+	}
+}
+
+// writeSourceURL records url for at least ttl, so what's cached for it can be found by URL.
+func writeSourceURL(url string, ttl time.Duration) {
+	key := getSourceURLCacheKey(url)
+	if stat, err := farsparkCache.Stat(key); err == nil && (stat.Expires.IsZero() || stat.Expires.After(time.Now().Add(ttl))) {
+		return
+	}
+	farsparkCache.Put(key, []byte(url), ttl)
+}
+
+// sourceVersion returns the version of the source at url which was last downloaded, or "" if
+// it's unknown, so that keys of things derived from it change when it does.
+func sourceVersion(url string) string {
+	info, _ := readSourceInfo(url)
+	return info.Version
+}
+
+func (i sourceInfo) fresh() bool {
+	return time.Now().Before(i.FreshUntil)
+}
+
+func (i sourceInfo) hasValidators() bool {
+	return len(i.ETag) > 0 || len(i.LastModified) > 0
+}
+
+// ttl returns how long the info, and the contents, are worth caching for: while they're fresh,
+// and for a while after if they can be revalidated.
+func (i sourceInfo) ttl() time.Duration {
+	ttl := time.Until(i.FreshUntil)
+	if i.hasValidators() {
+		ttl += staleSourceInfoTTL
+	}
+	return ttl
+}
+
+// update updates the info from the headers of a response from the origin, either with the
+// contents or confirming the cached ones are still current. It returns false if the origin
+// forbids storing the response.
+func (i *sourceInfo) update(header http.Header) bool {
+	if etag := header.Get("ETag"); len(etag) > 0 {
+		i.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); len(lastModified) > 0 {
+		i.LastModified = lastModified
+	}
+	i.CacheControl = header.Get("Cache-Control")
+
+	now := time.Now()
+	i.FreshUntil = now.Add(time.Duration(conf.CacheTTL) * time.Second)
+	storable := true
+
+	maxAge := -1
+	for _, directive := range strings.Split(strings.ToLower(i.CacheControl), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store":
+			storable = false
+			maxAge = 0
+		case directive == "no-cache":
+			maxAge = 0
+		case strings.HasPrefix(directive, "s-maxage="):
+			// Takes precedence over max-age for shared caches like us
+			if seconds, err := strconv.Atoi(directive[len("s-maxage="):]); err == nil && maxAge != 0 {
+				maxAge = seconds
+			}
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(directive[len("max-age="):]); err == nil && maxAge < 0 {
+				maxAge = seconds
+			}
+		}
+	}
+
+	if maxAge >= 0 {
+		age, _ := strconv.Atoi(header.Get("Age"))
+		i.FreshUntil = now.Add(time.Duration(maxAge-age) * time.Second)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		i.FreshUntil = expires
+	} else if len(header.Get("Expires")) > 0 {
+		// Invalid dates, like 0, mean it has already expired
+		i.FreshUntil = now
+	}
+
+	return storable
+}
+
+func setConditionalHeaders(req *http.Request, info sourceInfo) {
+	if len(info.ETag) > 0 {
+		req.Header.Set("If-None-Match", info.ETag)
+	}
+	if len(info.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", info.LastModified)
+	}
+}
+
+// storeSource caches what's needed to tell whether the source at url has changed, and the
+// contents too if they're worth keeping, given the headers they came with. Nothing is kept for
+// sources the origin forbids storing, or which would be stale right away with no way to
+// revalidate them.
+func storeSource(url string, data []byte, mimeType mimeType, header http.Header) {
+	info := sourceInfo{URL: url, Version: contentVersion(data)}
+	if !info.update(header) {
+		farsparkCache.Delete(getSourceInfoCacheKey(url))
+		return
+	}
+
+	if ttl := info.ttl(); ttl > 0 && shouldCacheMimeType(mimeType) {
+		info.BodyCached = farsparkCache.Put(getSourceCacheKey(url), data, ttl) == nil
+	}
+
+	writeSourceInfo(url, info)
+}
+
+// revalidateSource reports whether the last downloaded version of the source at url is still
+// current. Fresh sources are current without asking the origin; stale ones are revalidated with a
+// conditional GET, since some origins, like presigned URLs, only answer GETs. If the source has
+// changed, the new version the origin responded with is stored and returned, up to maxSize bytes,
+// so it doesn't have to be downloaded again. Anything derived from a source which isn't current
+// mustn't be reused.
+func revalidateSource(url string, maxSize int) (bool, *downloadResult) {
+	info, ok := readSourceInfo(url)
+	if !ok {
+		return false, nil
+	}
+	if info.fresh() {
+		return true, nil
+	}
+	if !info.hasValidators() {
+		return false, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, nil
+	}
+	setConditionalHeaders(req, info)
+
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return false, nil
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		info.update(res.Header)
+		writeSourceInfo(url, info)
+		return true, nil
+	case http.StatusOK:
+		data, err := readAndCheckMediaResponse(res, maxSize)
+		if err != nil {
+			return false, nil
+		}
+		mimeType := detectMediaType(data)
+		storeSource(url, data, mimeType, res.Header)
+		return false, &downloadResult{data: data, mimeType: mimeType}
+	}
+	return false, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_source_info_freshness(t *testing.T) {
+	cases := []struct {
+		header    http.Header
+		freshFor  time.Duration
+		storable  bool
+		validates bool
+	}{
+		{http.Header{}, time.Duration(conf.CacheTTL) * time.Second, true, false},
+		{http.Header{"Cache-Control": {"public, max-age=60"}, "Etag": {`"v1"`}}, time.Minute, true, true},
+		{http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}}, time.Minute, true, false},
+		{http.Header{"Cache-Control": {"max-age=600"}, "Age": {"540"}}, time.Minute, true, false},
+		{http.Header{"Cache-Control": {"no-cache, max-age=600"}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, 0, true, true},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, false, false},
+		{http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour, true, false},
+		{http.Header{"Expires": {"0"}}, 0, true, false},
+	}
+
+	for _, c := range cases {
+		var info sourceInfo
+		storable := info.update(c.header)
+		freshFor := time.Until(info.FreshUntil)
+		if storable != c.storable || info.hasValidators() != c.validates || freshFor > c.freshFor || freshFor < c.freshFor-2*time.Second {
+			t.Errorf("Unexpected info for %v: %+v, storable %v", c.header, info, storable)
+		}
+	}
+}
+
+func Test_download_revalidation(t *testing.T) {
+	defer allowLoopback()()
+	oldCache := farsparkCache
+	farsparkCache = newMemoryCache(1 << 20)
+	defer func() { farsparkCache = oldCache }()
+
+	body, etag := "%PDF-1.4 first", `"1"`
+	var requests, heads, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	data, _, err := downloadMedia(server.URL, 0)
+	if err != nil || string(data) != body {
+		t.Fatalf("Expected the source, got %q, %v", data, err)
+	}
+	firstKey := getMaxIndexCacheKey(server.URL, sourceVersion(server.URL))
+
+	if current, refetched := revalidateSource(server.URL, 0); !current || refetched != nil {
+		t.Fatal("Expected an unchanged source to be current")
+	}
+	data, _, err = downloadMedia(server.URL, 0)
+	if err != nil || string(data) != body || notModified != 2 {
+		t.Fatalf("Expected the cached source to be revalidated, got %q, %v after %d 304s", data, err, notModified)
+	}
+	if getMaxIndexCacheKey(server.URL, sourceVersion(server.URL)) != firstKey {
+		t.Fatal("Expected derived keys to stay the same while the source does")
+	}
+
+	body, etag = "%PDF-1.4 second", `"2"`
+	current, refetched := revalidateSource(server.URL, 0)
+	if current || refetched == nil || string(refetched.data) != body {
+		t.Fatal("Expected a changed source not to be current, and to be returned")
+	}
+	data, _, err = downloadMedia(server.URL, 0)
+	if err != nil || string(data) != body {
+		t.Fatalf("Expected the changed source, got %q, %v", data, err)
+	}
+	if getMaxIndexCacheKey(server.URL, sourceVersion(server.URL)) == firstKey {
+		t.Fatal("Expected derived keys to change along with the source")
+	}
+	if requests != 5 || heads != 0 || notModified != 3 {
+		t.Fatalf("Expected 5 conditional GETs to the origin, 3 of them not modified, got %d with %d HEADs and %d 304s", requests, heads, notModified)
+	}
+}
+
+func Test_download_fresh_source(t *testing.T) {
+	defer allowLoopback()()
+	oldCache := farsparkCache
+	farsparkCache = newMemoryCache(1 << 20)
+	defer func() { farsparkCache = oldCache }()
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("%PDF-1.4"))
+	}))
+	defer server.Close()
+
+	downloadMedia(server.URL, 0)
+	if data, _, err := downloadMedia(server.URL, 0); err != nil || string(data) != "%PDF-1.4" || requests != 1 {
+		t.Fatalf("Expected a fresh source to be served from the cache, got %q, %v after %d requests", data, err, requests)
+	}
+	if current, _ := revalidateSource(server.URL, 0); !current || requests != 1 {
+		t.Fatal("Expected a fresh source to be current without asking the origin")
+	}
+}
+
+func Test_store_source_expiry(t *testing.T) {
+	oldCache := farsparkCache
+	farsparkCache = newMemoryCache(1 << 20)
+	defer func() { farsparkCache = oldCache }()
+
+	storeSource("https://example.com/a.pdf", []byte("%PDF"), "application/pdf", http.Header{"Cache-Control": {"no-store"}})
+	storeSource("https://example.com/b.pdf", []byte("%PDF"), "application/pdf", http.Header{"Cache-Control": {"max-age=0"}})
+	for _, url := range []string{"https://example.com/a.pdf", "https://example.com/b.pdf"} {
+		if _, ok := readSourceInfo(url); ok || farsparkCache.Has(getSourceCacheKey(url)) {
+			t.Errorf("Expected nothing to be cached for %s", url)
+		}
+	}
+
+	storeSource("https://example.com/c.pdf", []byte("%PDF"), "application/pdf", http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"1"`}})
+	stat, err := farsparkCache.Stat(getSourceInfoCacheKey("https://example.com/c.pdf"))
+	if err != nil || stat.Expires.IsZero() || time.Until(stat.Expires) > staleSourceInfoTTL {
+		t.Fatalf("Expected the info to expire once it can't be revalidated anymore, got %+v, %v", stat, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// sourcePattern matches source URLs by scheme and host. Patterns look like "*.reticulum.io"
+// (any scheme), "s3://" (any host) or "https://*.example.com" (both).
+type sourcePattern struct {
+	Scheme string
+	Host   string
+}
+
+func parseSourcePatterns(patterns []string) []sourcePattern {
+	result := make([]sourcePattern, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if len(pattern) == 0 {
+			continue
+		}
+
+		var sp sourcePattern
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			sp.Scheme = pattern[:i]
+			sp.Host = pattern[i+3:]
+		} else {
+			sp.Host = pattern
+		}
+		result = append(result, sp)
+	}
+
+	return result
+}
+
+func (sp sourcePattern) Matches(u *url.URL) bool {
+	if len(sp.Scheme) > 0 {
+		if ok, _ := path.Match(sp.Scheme, strings.ToLower(u.Scheme)); !ok {
+			return false
+		}
+	}
+
+	if len(sp.Host) > 0 {
+		if ok, _ := path.Match(sp.Host, strings.ToLower(u.Hostname())); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesAnySource(patterns []sourcePattern, u *url.URL) bool {
+	for _, sp := range patterns {
+		if sp.Matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedSource reports whether media may be fetched from u. Denied patterns take precedence;
+// when allowed patterns are configured, u must match one of them.
+func isAllowedSource(u *url.URL) bool {
+	if matchesAnySource(conf.DeniedSources, u) {
+		return false
+	}
+
+	if len(conf.AllowedSources) > 0 && !matchesAnySource(conf.AllowedSources, u) {
+		return false
+	}
+
+	return true
+}
+
+func checkSourceURL(sourceURL string) error {
+	u, err := url.Parse(sourceURL)
+	if err != nil || !isAllowedSource(u) {
+		return sourceNotAllowedErr
+	}
+	return nil
+}
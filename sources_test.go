@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func withSourcePatterns(allowed []string, denied []string) func() {
+	oldConf := conf
+	conf.AllowedSources = parseSourcePatterns(allowed)
+	conf.DeniedSources = parseSourcePatterns(denied)
+	return func() { conf = oldConf }
+}
+
+func Test_source_patterns(t *testing.T) {
+	defer withSourcePatterns([]string{"*.reticulum.io", "s3://", "https://example.com"}, []string{"evil.reticulum.io"})()
+
+	cases := map[string]bool{
+		"https://asset-bundles-prod.reticulum.io/rooms/atrium.gltf": true,
+		"http://uploads.reticulum.io/a.png":                         true,
+		"https://evil.reticulum.io/a.png":                           false,
+		"https://reticulum.io.attacker.com/a.png":                   false,
+		"s3://bucket/key.pdf":                                       true,
+		"https://example.com/a.png":                                 true,
+		"http://example.com/a.png":                                  false,
+		"https://EXAMPLE.com/a.png":                                 true,
+	}
+
+	for source, expected := range cases {
+		if err := checkSourceURL(source); (err == nil) != expected {
+			t.Errorf("Expected allowed=%v for %s", expected, source)
+		}
+	}
+}
+
+func Test_source_patterns_deny_only(t *testing.T) {
+	defer withSourcePatterns(nil, []string{"*.internal"})()
+
+	if err := checkSourceURL("https://example.com/a.png"); err != nil {
+		t.Error("Expected example.com to be allowed.")
+	}
+	if err := checkSourceURL("https://db.internal/a.png"); err == nil {
+		t.Error("Expected db.internal to be denied.")
+	}
+}
+
+func Test_GLTF_disallowed_subresource(t *testing.T) {
+	defer withSourcePatterns([]string{"asset-bundles-prod.reticulum.io"}, nil)()
+
+	in := []byte(`{"images":[{"uri":"a.png"},{"uri":"https://elsewhere.com/b.png"}],"buffers":[]}`)
+	baseURL, _ := url.Parse("https://asset-bundles-prod.reticulum.io/rooms/atrium/Atrium.gltf")
+	serverURL, _ := url.Parse("http://localhost:8080")
+
+	if _, err := processGLTF(in, baseURL, serverURL, rewriteOptions{}); err != sourceNotAllowedErr {
+		t.Fatalf("Expected a GLTF referencing a disallowed source to be refused, got %v", err)
+	}
+
+	in = []byte(`{"images":[{"uri":"a.png"}],"buffers":[]}`)
+	result, err := processGLTF(in, baseURL, serverURL, rewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result), `"uri":"http://localhost:8080/0/raw/`) {
+		t.Fatalf("Expected allowed subresource to be rewritten: %s", result)
+	}
+}
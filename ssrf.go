@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// Address ranges which media may never be downloaded from, unless explicitly allowed through
+// FARSPARK_ALLOWED_NETWORKS or FARSPARK_ALLOWED_HOSTS.
+var blockedCIDRs = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"64:ff9b:1::/48", // local IPv4/IPv6 translation
+	"2001::/32",      // Teredo, which embeds an IPv4 address
+	"2002::/16",      // 6to4, which embeds an IPv4 address
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+var blockedNetworks []*net.IPNet
+
+type blockedAddressError struct {
+	Address string
+}
+
+func (e blockedAddressError) Error() string {
+	return fmt.Sprintf("Address %s is not allowed", e.Address)
+}
+
+func initBlockedNetworks() {
+	blockedNetworks = make([]*net.IPNet, len(blockedCIDRs))
+
+	for i, cidr := range blockedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("Invalid blocked network %s: %s\n", cidr, err)
+		}
+		blockedNetworks[i] = network
+	}
+}
+
+func isAllowedIP(ip net.IP) bool {
+	for _, network := range conf.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isAllowedHost(host string) bool {
+	for _, allowed := range conf.AllowedHosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDialAddress is used as the Control function of the download dialer. It runs after DNS
+// resolution, right before connecting, so it sees the actual IP address being dialed and can't
+// be fooled by DNS rebinding.
+func checkDialAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return blockedAddressError{address}
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isAllowedIP(ip) {
+		return blockedAddressError{address}
+	}
+
+	return nil
+}
+
+func newGuardedDialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	guardedDialer := *dialer
+	guardedDialer.Control = checkDialAddress
+
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && isAllowedHost(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		return guardedDialer.DialContext(ctx, network, address)
+	}
+}
+
+// checkHostAddresses rejects hosts which resolve to blocked addresses, unless they're allowed by
+// name.
+func checkHostAddresses(host string) error {
+	if isAllowedHost(host) {
+		return nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if !isAllowedIP(ip) {
+			return blockedAddressError{host}
+		}
+	}
+
+	return nil
+}
+
+// checkRedirect rejects redirects to sources which aren't allowed, and to blocked addresses early,
+// before any connection is attempted. The dialer re-checks the address actually connected to.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if err := checkSourceURL(req.URL.String()); err != nil {
+		return err
+	}
+
+	return checkHostAddresses(req.URL.Hostname())
+}
+
+// newGuardedProxy wraps proxy so the addresses of targets are checked before requests are sent
+// through a proxy, since the dialer then only sees the proxy's address. The proxy resolves the
+// target again, so unlike direct connections, this can be fooled by DNS rebinding; proxies should
+// block private addresses themselves too.
+func newGuardedProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		if err := checkHostAddresses(req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+
+		return proxyURL, nil
+	}
+}
+
+func isBlockedAddressError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case blockedAddressError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+// downloadError turns errors caused by blocked addresses into a farsparkError, unwraps those
+// returned by checkRedirect, and leaves everything else untouched.
+func downloadError(err error) error {
+	if isBlockedAddressError(err) {
+		return newError(403, err.Error(), "Source address is not allowed")
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		if ferr, ok := urlErr.Err.(farsparkError); ok {
+			return ferr
+		}
+	}
+
+	return err
+}
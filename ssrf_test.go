@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func Test_blocked_IPs(t *testing.T) {
+	blocked := []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "224.0.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+		"100.64.0.1",                           // carrier-grade NAT
+		"198.18.0.1",                           // benchmarking
+		"64:ff9b::7f00:1",                      // NAT64 of 127.0.0.1
+		"64:ff9b:1::a00:1",                     // local NAT64 of 10.0.0.1
+		"2001:0:4136:e378:8000:63bf:80ff:fffe", // Teredo of 127.0.0.1
+		"2002:7f00:1::1",                       // 6to4 of 127.0.0.1
+	}
+	allowed := []string{"8.8.8.8", "93.184.216.34", "2606:4700::1111"}
+
+	for _, addr := range blocked {
+		if isAllowedIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be blocked.", addr)
+		}
+	}
+	for _, addr := range allowed {
+		if !isAllowedIP(net.ParseIP(addr)) {
+			t.Errorf("Expected %s to be allowed.", addr)
+		}
+	}
+}
+
+func Test_download_blocked_address(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	_, _, err := downloadMedia(server.URL, 0)
+	if ferr, ok := err.(farsparkError); !ok || ferr.StatusCode != 403 {
+		t.Fatalf("Expected 403 error, got %v", err)
+	}
+}
+
+func Test_download_blocked_redirect(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("secret"))
+	}))
+	defer target.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "http://localhost:"+target.URL[len("http://127.0.0.1:"):], http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	// Only the redirecting server is allowed, by IP; the redirect target is reached by hostname
+	conf.AllowedHosts = []string{"127.0.0.1"}
+
+	_, _, err := downloadMedia(redirector.URL, 0)
+	if ferr, ok := err.(farsparkError); !ok || ferr.StatusCode != 403 {
+		t.Fatalf("Expected 403 error, got %v", err)
+	}
+}
+
+func Test_download_allowed_network(t *testing.T) {
+	defer allowLoopback()()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	data, _, err := downloadMedia(server.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatal("Unexpected output.")
+	}
+}
+
+func Test_download_through_proxy(t *testing.T) {
+	defer allowLoopback()()
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		rw.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	oldClient := downloadClient
+	defer func() { downloadClient = oldClient }()
+	downloadClient = &http.Client{
+		Transport: newDownloadTransport(func(req *http.Request) (*url.URL, error) {
+			return url.Parse(os.Getenv("HTTP_PROXY"))
+		}),
+		CheckRedirect: checkRedirect,
+	}
+
+	// The dialer only sees the proxy, which is allowed, so targets have to be checked beforehand
+	_, _, err := downloadMedia("http://169.254.169.254/latest/meta-data/", 0)
+	if ferr, ok := err.(farsparkError); !ok || ferr.StatusCode != 403 {
+		t.Fatalf("Expected 403 error, got %v", err)
+	}
+	if len(proxied) != 0 {
+		t.Fatalf("Expected nothing to be sent to the proxy, got %v", proxied)
+	}
+
+	_, link, _ := net.ParseCIDR("169.254.0.0/16")
+	conf.AllowedNetworks = append(conf.AllowedNetworks, link)
+	if data, _, err := downloadMedia("http://169.254.169.254/latest/meta-data/", 0); err != nil || string(data) != "proxied" {
+		t.Fatalf("Expected allowed targets to be proxied, got %q, %v", data, err)
+	}
+}
+
+func Test_download_denied_redirect(t *testing.T) {
+	defer allowLoopback()()
+
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("secret"))
+	}))
+	defer target.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "http://localhost:"+target.URL[len("http://127.0.0.1:"):], http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	conf.DeniedSources = parseSourcePatterns([]string{"localhost"})
+
+	_, _, err := downloadMedia(redirector.URL, 0)
+	if err != sourceNotAllowedErr {
+		t.Fatalf("Expected the redirect to a denied source to be rejected, got %v", err)
+	}
+}
@@ -1,7 +1,15 @@
 package main
 import (
+	"bytes"
 	"errors"
 	"github.com/mqp/lilliput"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/jpeg" // for scaleLargeImage
+	"image/png"
+	"time"
+
+	_ "golang.org/x/image/webp" // for scaleLargeImage
 )
 
 type OutputBuffer struct {
@@ -13,6 +21,7 @@ var EncodeOptions = map[mimeType]map[int]int{
 	"image/gif": map[int]int{},
 	"image/jpeg": map[int]int{lilliput.JpegQuality: 85},
 	"image/png":  map[int]int{lilliput.PngCompression: 7},
+	"image/webp": map[int]int{lilliput.WebpQuality: 85},
 }
 
 // Map from output media type to Lilliput output file type identifier.
@@ -20,6 +29,7 @@ var outputFileTypes = map[mimeType]string{
 	"image/gif": ".gif",
 	"image/jpeg": ".jpeg",
 	"image/png":  ".png",
+	"image/webp": ".webp",
 }
 
 // Our in-world GIF search shows up to 25 GIF results at once,
@@ -34,6 +44,123 @@ func processImage(data []byte, outputFormat mimeType, width int, height int, t *
 	defer decoder.Close()
 	t.Check()
 
+	return transformImage(decoder, outputFormat, width, height, EncodeOptions[outputFormat], t)
+}
+
+// scaleWithin returns the size an image of the given size is scaled down to so it fits within
+// maxDimension pixels in either direction, keeping its aspect ratio. Smaller images keep their size.
+func scaleWithin(width int, height int, maxDimension int) (int, int) {
+	if width <= maxDimension && height <= maxDimension {
+		return width, height
+	}
+
+	scaledWidth, scaledHeight := maxDimension, maxDimension
+	if width >= height {
+		scaledHeight = (height*maxDimension + width/2) / width
+	} else {
+		scaledWidth = (width*maxDimension + height/2) / height
+	}
+
+	if scaledWidth < 1 {
+		scaledWidth = 1
+	}
+	if scaledHeight < 1 {
+		scaledHeight = 1
+	}
+	return scaledWidth, scaledHeight
+}
+
+// downscaleImage encodes data as outputFormat, scaled down to fit within maxDimension pixels in
+// either direction if it doesn't already. Unlike the other transforms, it accepts sources larger
+// than conf.MaxDimension, as long as they're within conf.MaxResolution pixels.
+func downscaleImage(data []byte, outputFormat mimeType, maxDimension int, t *timer) ([]byte, error) {
+	decoder, err := lilliput.NewDecoder(data)
+	if err != nil {
+		return nil, errors.New("Error initializing image decoder")
+	}
+	defer decoder.Close()
+
+	header, err := decoder.Header()
+	if err != nil {
+		return nil, errors.New("Error reading image header")
+	}
+	t.Check()
+
+	width, height := scaleWithin(header.Width(), header.Height(), maxDimension)
+	if header.Width() <= conf.MaxDimension && header.Height() <= conf.MaxDimension {
+		return transformImage(decoder, outputFormat, width, height, EncodeOptions[outputFormat], t)
+	}
+
+	if int64(header.Width())*int64(header.Height()) > int64(conf.MaxResolution) {
+		return nil, errors.New("Source image is too big")
+	}
+
+	// lilliput only decodes images up to conf.MaxDimension, so larger ones are scaled down in Go
+	// first. EXIF orientation isn't applied to them.
+	scaled, err := scaleLargeImage(data, width, height)
+	if err != nil {
+		return nil, err
+	}
+	t.Check()
+
+	scaledDecoder, err := lilliput.NewDecoder(scaled)
+	if err != nil {
+		return nil, errors.New("Error initializing image decoder")
+	}
+	defer scaledDecoder.Close()
+
+	return transformImage(scaledDecoder, outputFormat, width, height, EncodeOptions[outputFormat], t)
+}
+
+// scaleLargeImage decodes data with the standard image decoders and scales it to the given size,
+// returning it as an uncompressed PNG.
+func scaleLargeImage(data []byte, width int, height int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("Error decoding image")
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var out bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&out, dst); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// encodeOptionsWithQuality returns the encode options for outputFormat, using the given quality
+// for lossy formats.
+func encodeOptionsWithQuality(outputFormat mimeType, quality int) map[int]int {
+	switch outputFormat {
+	case "image/jpeg":
+		return map[int]int{lilliput.JpegQuality: quality}
+	case "image/webp":
+		return map[int]int{lilliput.WebpQuality: quality}
+	}
+	return EncodeOptions[outputFormat]
+}
+
+// transcodeImage re-encodes data as outputFormat without resizing it.
+func transcodeImage(data []byte, outputFormat mimeType, quality int) ([]byte, error) {
+	decoder, err := lilliput.NewDecoder(data)
+	if err != nil {
+		return nil, errors.New("Error initializing image decoder")
+	}
+	defer decoder.Close()
+
+	header, err := decoder.Header()
+	if err != nil {
+		return nil, errors.New("Error reading image header")
+	}
+
+	t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Transcoding")
+	return transformImage(decoder, outputFormat, header.Width(), header.Height(), encodeOptionsWithQuality(outputFormat, quality), t)
+}
+
+func transformImage(decoder lilliput.Decoder, outputFormat mimeType, width int, height int, encodeOptions map[int]int, t *timer) ([]byte, error) {
 	header, err := decoder.Header()
 	if err != nil {
 		return nil, errors.New("Error reading image header")
@@ -77,7 +204,7 @@ func processImage(data []byte, outputFormat mimeType, width int, height int, t *
 		Height:               height,
 		ResizeMethod:         lilliput.ImageOpsFit,
 		NormalizeOrientation: true,
-		EncodeOptions:        EncodeOptions[outputFormat],
+		EncodeOptions:        encodeOptions,
 	}
 	return outputBuffer.ops.Transform(decoder, opts, outputBuffer.buf)
 }
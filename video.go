@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/mqp/lilliput"
+)
+
+var videoMimeTypes = map[mimeType]bool{
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/quicktime": true,
+}
+
+func getDurationCacheKey(url string, version string) string {
+	return getIndexCacheKey(url, version, 0, "duration")
+}
+
+// checkFFmpeg returns a 501 error if the ffmpeg binary frames are extracted with can't be found.
+// It's only needed for videos, so deployments which don't extract from them can go without it.
+func checkFFmpeg() error {
+	if _, err := exec.LookPath(conf.FFmpegPath); err != nil {
+		return newError(501, fmt.Sprintf("ffmpeg is unavailable: %s", err), "Video frame extraction is unavailable")
+	}
+	return nil
+}
+
+// extractVideoFrame returns the frame at opts.Timestamp seconds, or at index seconds if no
+// timestamp was requested, along with the maximum index, which is the last whole second of the
+// video rather than a frame, and the duration of the video.
+func extractVideoFrame(data []byte, url string, index int, opts extractOptions, t *timer) ([]byte, int, time.Duration, error) {
+	if err := checkFFmpeg(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	// lilliput can only decode the first frame, so it's only used for the duration, and frames are
+	// extracted with ffmpeg
+	decoder, err := lilliput.NewDecoder(data)
+	if err != nil {
+		return nil, 0, 0, errors.New("Error initializing video decoder")
+	}
+	defer decoder.Close()
+	t.Check()
+
+	duration := decoder.Duration()
+	maxSecond := int(duration / time.Second) // indexes of videos are seconds
+
+	timestamp, err := videoFrameTimestamp(index, opts, duration)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	outBytes, err := extractVideoFrameWithFFmpeg(data, timestamp)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	t.Check()
+
+	if opts.Format != "image/png" {
+		if outBytes, err = transcodeImage(outBytes, opts.Format, opts.quality()); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	if farsparkCache != nil {
+		version := sourceVersion(url)
+		farsparkCache.Put(getIndexContentsCacheKey(url, version, index, opts.cacheVariant()), outBytes, 0)
+		farsparkCache.Put(getMaxIndexCacheKey(url, version), []byte(strconv.Itoa(maxSecond)), 0)
+		farsparkCache.Put(getDurationCacheKey(url, version), []byte(strconv.FormatFloat(duration.Seconds(), 'f', -1, 64)), 0)
+	}
+
+	return outBytes, maxSecond, duration, nil
+}
+
+// videoFrameTimestamp returns the time in seconds of the frame requested by index or opts in a
+// video of the given duration. Frames past the end are out of range, unless the duration isn't
+// known, in which case ffmpeg finds out whether there's a frame.
+func videoFrameTimestamp(index int, opts extractOptions, duration time.Duration) (float64, error) {
+	timestamp := opts.Timestamp
+	if timestamp < 0 {
+		timestamp = float64(index)
+	}
+
+	if duration > 0 && timestamp > duration.Seconds() {
+		return 0, errIndexOutOfRange
+	}
+	return timestamp, nil
+}
+
+// extractVideoFrameWithFFmpeg returns the frame at timestamp as a PNG, scaled down to fit within
+// conf.MaxDimension pixels in either direction if it doesn't already.
+func extractVideoFrameWithFFmpeg(data []byte, timestamp float64) ([]byte, error) {
+	inFile, err := ioutil.TempFile("", "farspark-video")
+	if err != nil {
+		return nil, errors.New("Error creating temporary video file")
+	}
+	defer os.Remove(inFile.Name())
+
+	_, err = inFile.Write(data)
+	inFile.Close()
+	if err != nil {
+		return nil, errors.New("Error writing temporary video file")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.WriteTimeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, conf.FFmpegPath,
+		"-nostdin",
+		"-loglevel", "error",
+		"-ss", strconv.FormatFloat(timestamp, 'f', -1, 64),
+		"-i", inFile.Name(),
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale='min(iw,%[1]d)':'min(ih,%[1]d)':force_original_aspect_ratio=decrease", conf.MaxDimension),
+		"-c:v", "png",
+		"-f", "image2pipe",
+		"pipe:1",
+	)
+
+	outBytes, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("ffmpeg failed: %s", exitErr.Stderr)
+		}
+		return nil, err
+	}
+
+	if len(outBytes) == 0 {
+		return nil, errors.New("ffmpeg produced no frame")
+	}
+
+	return outBytes, nil
+}
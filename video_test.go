@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_extract_video_frame_with_ffmpeg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "farspark-fake-ffmpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only output the frame when it's seeked to and scaled down to fit within the max dimension
+	path := filepath.Join(dir, "ffmpeg")
+	script := `#!/bin/sh
+case "$*" in
+  *"-ss 1.5 "*"scale='min(iw,100)':'min(ih,100)':force_original_aspect_ratio=decrease"*) cat "` + filepath.Join(dataDir, "in0.png") + `" ;;
+  *) echo "unexpected arguments: $*" >&2; exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf.FFmpegPath = path
+	conf.MaxDimension = 100
+
+	frame, err := extractVideoFrameWithFFmpeg([]byte("video"), 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png, err := ioutil.ReadFile(filepath.Join(dataDir, "in0.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, png) {
+		t.Fatal("Expected the frame ffmpeg extracted")
+	}
+}
+
+func Test_extract_video_frame_without_ffmpeg(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf.FFmpegPath = "/nonexistent/ffmpeg"
+
+	opts := extractOptions{Format: "image/png", Timestamp: -1}
+	timer := startTimer(time.Second, "Processing")
+	_, _, _, err := extractVideoFrame([]byte("video"), "dummy", 0, opts, timer)
+	if ferr, ok := err.(farsparkError); !ok || ferr.StatusCode != 501 {
+		t.Fatalf("Expected a 501 error, got %v", err)
+	}
+}
+
+func Test_video_frame_timestamp(t *testing.T) {
+	byIndex := extractOptions{Timestamp: -1}
+	cases := []struct {
+		index    int
+		opts     extractOptions
+		duration time.Duration
+		expected float64
+		err      error
+	}{
+		{3, byIndex, 10 * time.Second, 3, nil},
+		{0, extractOptions{Timestamp: 2.5}, 10 * time.Second, 2.5, nil},
+		{11, byIndex, 10 * time.Second, 0, errIndexOutOfRange},
+		{0, extractOptions{Timestamp: 10.5}, 10 * time.Second, 0, errIndexOutOfRange},
+		// Without a known duration, ffmpeg decides
+		{42, byIndex, 0, 42, nil},
+	}
+
+	for _, c := range cases {
+		timestamp, err := videoFrameTimestamp(c.index, c.opts, c.duration)
+		if timestamp != c.expected || err != c.err {
+			t.Errorf("Expected index %d, t=%g of %s to be at %g (%v), got %g (%v)", c.index, c.opts.Timestamp, c.duration, c.expected, c.err, timestamp, err)
+		}
+	}
+}